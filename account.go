@@ -0,0 +1,236 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/cockroachdb/cockroach-go/crdb"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// DeleteAccountInput request body
+type DeleteAccountInput struct {
+	Password string `json:"password,omitempty"`
+}
+
+const purgeInterval = time.Hour
+
+// accountDeletionGracePeriod delays the purge of deleted accounts.
+// Logging in again within it cancels the deletion.
+// With none, accounts are purged right away.
+var accountDeletionGracePeriod time.Duration
+
+// purgeQueries remove everything of a user, in dependency order,
+// fixing the counters of what they touched.
+var purgeQueries = []string{
+	// Follows.
+	`UPDATE users SET followers_count = followers_count - 1
+	WHERE id IN (SELECT following_id FROM follows WHERE follower_id = $1)`,
+	`UPDATE users SET following_count = following_count - 1
+	WHERE id IN (SELECT follower_id FROM follows WHERE following_id = $1)`,
+	`DELETE FROM follows WHERE follower_id = $1 OR following_id = $1`,
+	`DELETE FROM follow_requests WHERE follower_id = $1 OR following_id = $1`,
+	`DELETE FROM blocks WHERE blocker_id = $1 OR blocked_id = $1`,
+	`DELETE FROM mutes WHERE muter_id = $1 OR muted_id = $1`,
+
+	// Likes given.
+	`UPDATE posts SET likes_count = likes_count - 1
+	WHERE id IN (SELECT post_id FROM post_likes WHERE user_id = $1)`,
+	`DELETE FROM post_likes WHERE user_id = $1`,
+	`UPDATE comments SET likes_count = likes_count - 1
+	WHERE id IN (SELECT comment_id FROM comment_likes WHERE user_id = $1)`,
+	`DELETE FROM comment_likes WHERE user_id = $1`,
+
+	// Comments, along with the likes they got.
+	`UPDATE posts SET comments_count = comments_count - (
+		SELECT count(*) FROM comments WHERE post_id = posts.id AND user_id = $1
+	)
+	WHERE id IN (SELECT post_id FROM comments WHERE user_id = $1)`,
+	`DELETE FROM comment_likes WHERE comment_id IN (SELECT id FROM comments WHERE user_id = $1)`,
+	`DELETE FROM comments WHERE user_id = $1`,
+
+	// Posts, along with everything others did on them.
+	`DELETE FROM notifications
+	WHERE (verb = 'post_mention' AND object_id IN (SELECT id FROM posts WHERE user_id = $1))
+		OR (verb IN ('comment', 'comment_mention') AND target_id IN (SELECT id FROM posts WHERE user_id = $1))`,
+	`DELETE FROM comment_likes WHERE comment_id IN (
+		SELECT id FROM comments WHERE post_id IN (SELECT id FROM posts WHERE user_id = $1)
+	)`,
+	`DELETE FROM comments WHERE post_id IN (SELECT id FROM posts WHERE user_id = $1)`,
+	`DELETE FROM post_likes WHERE post_id IN (SELECT id FROM posts WHERE user_id = $1)`,
+	`DELETE FROM subscriptions WHERE post_id IN (SELECT id FROM posts WHERE user_id = $1)`,
+	`DELETE FROM feed WHERE post_id IN (SELECT id FROM posts WHERE user_id = $1)`,
+	`DELETE FROM posts WHERE user_id = $1`,
+
+	`DELETE FROM subscriptions WHERE user_id = $1`,
+	`DELETE FROM feed WHERE user_id = $1`,
+	`DELETE FROM notifications WHERE user_id = $1 OR actor_id = $1`,
+
+	// Auth.
+	`DELETE FROM refresh_tokens WHERE user_id = $1`,
+	`DELETE FROM sessions WHERE user_id = $1`,
+	`DELETE FROM personal_tokens WHERE user_id = $1`,
+	`DELETE FROM identities WHERE user_id = $1`,
+	`DELETE FROM recovery_codes WHERE user_id = $1`,
+	`DELETE FROM login_tokens WHERE user_id = $1`,
+	`DELETE FROM password_reset_tokens WHERE user_id = $1`,
+	`DELETE FROM email_verification_tokens WHERE user_id = $1`,
+	`DELETE FROM email_changes WHERE user_id = $1`,
+	`DELETE FROM security_events WHERE user_id = $1`,
+	`UPDATE security_events SET actor_id = NULL WHERE actor_id = $1`,
+
+	`DELETE FROM users WHERE id = $1`,
+}
+
+func deleteAccount(w http.ResponseWriter, r *http.Request) {
+	var input DeleteAccountInput
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer r.Body.Close()
+
+	ctx := r.Context()
+	authUserID := ctx.Value(keyAuthUserID).(string)
+
+	var passwordHash []byte
+	if err := db.QueryRowContext(ctx, "SELECT password_hash FROM users WHERE id = $1", authUserID).
+		Scan(&passwordHash); err != nil {
+		respondError(w, fmt.Errorf("could not query user to delete: %v", err))
+		return
+	}
+
+	if passwordHash != nil && bcrypt.CompareHashAndPassword(passwordHash, []byte(input.Password)) != nil {
+		recordSecurityEvent(r, authUserID, eventAccountDeletionScheduled, outcomeFailure)
+		respondJSON(w, map[string]string{
+			"password": "Wrong password",
+		}, http.StatusUnprocessableEntity)
+		return
+	}
+
+	if accountDeletionGracePeriod <= 0 {
+		var avatarURL *string
+		if err := crdb.ExecuteTx(ctx, db, nil, func(tx *sql.Tx) error {
+			var err error
+			avatarURL, err = purgeUser(tx, authUserID)
+			return err
+		}); err != nil {
+			respondError(w, fmt.Errorf("could not purge user: %v", err))
+			return
+		}
+
+		userCache.Invalidate(authUserID)
+		if avatarURL != nil {
+			go deleteAvatar(*avatarURL)
+		}
+
+		clearAuthCookies(w)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	if err := crdb.ExecuteTx(ctx, db, nil, func(tx *sql.Tx) error {
+		if _, err := tx.Exec(`
+			UPDATE users SET delete_at = $1
+			WHERE id = $2
+			RETURNING NOTHING
+		`, time.Now().Add(accountDeletionGracePeriod), authUserID); err != nil {
+			return err
+		}
+
+		if _, err := tx.Exec(`
+			DELETE FROM personal_tokens WHERE user_id = $1
+			RETURNING NOTHING
+		`, authUserID); err != nil {
+			return err
+		}
+
+		return revokeUserSessions(ctx, tx, authUserID, "")
+	}); err != nil {
+		respondError(w, fmt.Errorf("could not schedule user deletion: %v", err))
+		return
+	}
+
+	recordSecurityEvent(r, authUserID, eventAccountDeletionScheduled, outcomeSuccess)
+
+	clearAuthCookies(w)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// purgeUser deletes a user and all its data.
+// It returns the avatar URL, if any,
+// for the files to be deleted once the transaction commits,
+// when the cached user has to be invalidated too.
+func purgeUser(tx *sql.Tx, userID string) (*string, error) {
+	var avatarURL *string
+	if err := tx.QueryRow("SELECT avatar_url FROM users WHERE id = $1", userID).
+		Scan(&avatarURL); err != nil {
+		return nil, err
+	}
+
+	for _, query := range purgeQueries {
+		if _, err := tx.Exec(query, userID); err != nil {
+			return nil, err
+		}
+	}
+	return avatarURL, nil
+}
+
+// purgeDeletedUsers purges the users whose grace period is over, every purgeInterval.
+func purgeDeletedUsers() {
+	ticker := time.NewTicker(purgeInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		rows, err := db.Query("SELECT id FROM users WHERE delete_at <= now()")
+		if err != nil {
+			log.Printf("could not query users to purge: %v\n", err)
+			continue
+		}
+
+		var userIDs []string
+		for rows.Next() {
+			var userID string
+			if err = rows.Scan(&userID); err != nil {
+				log.Printf("could not scan user to purge: %v\n", err)
+				break
+			}
+			userIDs = append(userIDs, userID)
+		}
+		if err = rows.Err(); err != nil {
+			log.Printf("could not iterate over users to purge: %v\n", err)
+		}
+		rows.Close()
+
+		for _, userID := range userIDs {
+			var avatarURL *string
+			if err := crdb.ExecuteTx(context.Background(), db, nil, func(tx *sql.Tx) error {
+				avatarURL = nil
+
+				// They could have logged in since.
+				var due bool
+				if err := tx.QueryRow("SELECT COALESCE(delete_at <= now(), false) FROM users WHERE id = $1", userID).
+					Scan(&due); err != nil || !due {
+					return err
+				}
+
+				var err error
+				avatarURL, err = purgeUser(tx, userID)
+				return err
+			}); err != nil {
+				log.Printf("could not purge user %s: %v\n", userID, err)
+				continue
+			}
+
+			userCache.Invalidate(userID)
+			if avatarURL != nil {
+				deleteAvatar(*avatarURL)
+			}
+		}
+	}
+}
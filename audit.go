@@ -0,0 +1,151 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// SecurityEvent model
+type SecurityEvent struct {
+	ID            string    `json:"id"`
+	Event         string    `json:"event"`
+	Outcome       string    `json:"outcome"`
+	ActorUsername *string   `json:"actorUsername"`
+	IP            string    `json:"ip"`
+	UserAgent     string    `json:"userAgent"`
+	CreatedAt     time.Time `json:"createdAt"`
+}
+
+// Security events.
+const (
+	eventLogin                    = "login"
+	eventLoginLinkSent            = "login_link_sent"
+	eventTOTPChallenge            = "totp_challenge"
+	eventLogout                   = "logout"
+	eventRefreshTokenReused       = "refresh_token_reused"
+	eventUserCreated              = "user_created"
+	eventEmailVerified            = "email_verified"
+	eventEmailChangeRequested     = "email_change_requested"
+	eventEmailChanged             = "email_changed"
+	eventEmailChangeCanceled      = "email_change_canceled"
+	eventPasswordChanged          = "password_changed"
+	eventPasswordResetRequested   = "password_reset_requested"
+	eventPasswordReset            = "password_reset"
+	eventTOTPEnabled              = "totp_enabled"
+	eventTOTPDisabled             = "totp_disabled"
+	eventPersonalTokenCreated     = "personal_token_created"
+	eventPersonalTokenDeleted     = "personal_token_deleted"
+	eventSessionRevoked           = "session_revoked"
+	eventSessionsRevoked          = "sessions_revoked"
+	eventAccountDeletionScheduled = "account_deletion_scheduled"
+	eventProfileUpdated           = "profile_updated"
+	eventFollow                   = "follow"
+	eventUnfollow                 = "unfollow"
+	eventFollowRequested          = "follow_requested"
+	eventFollowRequestCanceled    = "follow_request_canceled"
+	eventFollowRequestApproved    = "follow_request_approved"
+	eventFollowRequestRejected    = "follow_request_rejected"
+	eventBlock                    = "block"
+	eventUnblock                  = "unblock"
+	eventMute                     = "mute"
+	eventUnmute                   = "unmute"
+	eventRoleChanged              = "role_changed"
+	eventSuspended                = "suspended"
+	eventUnsuspended              = "unsuspended"
+	eventBanned                   = "banned"
+	eventUnbanned                 = "unbanned"
+)
+
+// Outcomes of security events.
+const (
+	outcomeSuccess = "success"
+	outcomeFailure = "failure"
+)
+
+const securityEventsPageSize = 50
+
+// recordSecurityEvent appends an event about the account of userID to the audit log.
+// The actor is the authenticated user, if any, which differs from userID
+// when a moderator acts on someone else's account.
+// An empty userID stands for an unknown account, like a login with a nonexistent email.
+func recordSecurityEvent(r *http.Request, userID, event, outcome string) {
+	actorID, _ := r.Context().Value(keyAuthUserID).(string)
+	ip := clientIP(r)
+	userAgent := r.UserAgent()
+
+	go func() {
+		if _, err := db.Exec(`
+			INSERT INTO security_events (user_id, actor_id, event, outcome, ip, user_agent)
+			VALUES (NULLIF($1, '')::INT, NULLIF($2, '')::INT, $3, $4, $5, $6)
+			RETURNING NOTHING
+		`, userID, actorID, event, outcome, ip, userAgent); err != nil {
+			log.Printf("could not record security event %s: %v\n", event, err)
+		}
+	}()
+}
+
+func getSecurityEvents(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	authUserID := ctx.Value(keyAuthUserID).(string)
+
+	query := `
+		SELECT
+			security_events.id,
+			security_events.event,
+			security_events.outcome,
+			actors.username,
+			security_events.ip,
+			security_events.user_agent,
+			security_events.created_at
+		FROM security_events
+		LEFT JOIN users AS actors ON security_events.actor_id = actors.id
+		WHERE security_events.user_id = $1`
+	args := []interface{}{authUserID}
+	if s := r.URL.Query().Get("before"); s != "" {
+		before, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid before", http.StatusBadRequest)
+			return
+		}
+		query += ` AND security_events.id < $2`
+		args = append(args, before)
+	}
+	query += fmt.Sprintf(`
+		ORDER BY security_events.id DESC
+		LIMIT %d`, securityEventsPageSize)
+
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		respondError(w, fmt.Errorf("could not query security events: %v", err))
+		return
+	}
+	defer rows.Close()
+
+	events := make([]SecurityEvent, 0)
+	for rows.Next() {
+		var event SecurityEvent
+		if err = rows.Scan(
+			&event.ID,
+			&event.Event,
+			&event.Outcome,
+			&event.ActorUsername,
+			&event.IP,
+			&event.UserAgent,
+			&event.CreatedAt,
+		); err != nil {
+			respondError(w, fmt.Errorf("could not scan security event: %v", err))
+			return
+		}
+
+		events = append(events, event)
+	}
+	if err = rows.Err(); err != nil {
+		respondError(w, fmt.Errorf("could not iterate over security events: %v", err))
+		return
+	}
+
+	respondJSON(w, events, http.StatusOK)
+}
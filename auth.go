@@ -2,26 +2,42 @@ package main
 
 import (
 	"context"
+	"crypto/rand"
+	"crypto/sha256"
 	"database/sql"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
+	"log"
 	"net/http"
+	"net/url"
+	"regexp"
 	"strings"
 	"time"
 
+	"github.com/cockroachdb/cockroach-go/crdb"
 	"github.com/dgrijalva/jwt-go"
 )
 
 // LoginInput request body
 type LoginInput struct {
-	Email string `json:"email"`
+	Email    string `json:"email"`
+	Password string `json:"password,omitempty"`
 }
 
 // LoginPayload response body
 type LoginPayload struct {
-	User      User      `json:"user"`
-	JWT       string    `json:"jwt"`
-	ExpiresAt time.Time `json:"expiresAt"`
+	User                  User      `json:"user"`
+	JWT                   string    `json:"jwt"`
+	ExpiresAt             time.Time `json:"expiresAt"`
+	RefreshToken          string    `json:"refreshToken"`
+	RefreshTokenExpiresAt time.Time `json:"refreshTokenExpiresAt"`
+}
+
+// Claims of the access JWT.
+type Claims struct {
+	jwt.StandardClaims
+	TokenType string `json:"token_type"`
 }
 
 // ContextKey used in middlewares
@@ -30,17 +46,21 @@ type ContextKey int
 const (
 	keyAuthUserID ContextKey = iota
 	keyAuthUser
+	keySessionID
+	keyAuthScopes
+	keyAllowUnverified
 )
 
-const year = time.Hour * 24 * 365
+const (
+	loginTokenLifespan   = time.Minute * 15
+	accessTokenLifespan  = time.Minute * 15
+	refreshTokenLifespan = time.Hour * 24 * 30
+)
 
-var jwtKey = []byte(env("JWT_KEY", "secret"))
+const accessTokenType = "access"
 
-func jwtKeyfunc(*jwt.Token) (interface{}, error) {
-	return jwtKey, nil
-}
+var rxEmail = regexp.MustCompile(`^[^\s@]+@[^\s@]+\.[^\s@]+$`)
 
-// TODO: make it secure
 func login(w http.ResponseWriter, r *http.Request) {
 	var input LoginInput
 	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
@@ -49,72 +69,278 @@ func login(w http.ResponseWriter, r *http.Request) {
 	}
 	defer r.Body.Close()
 
-	email := input.Email
-	// TODO: validate input, passwordless
+	email := strings.TrimSpace(input.Email)
+	if !rxEmail.MatchString(email) {
+		respondJSON(w, map[string]string{
+			"email": "Invalid email",
+		}, http.StatusUnprocessableEntity)
+		return
+	}
+
+	throttleKey := emailThrottleKey("login", email)
+	if throttled(w, ipLoginThrottler, ipThrottleKey("login", r)) ||
+		throttled(w, loginThrottler, throttleKey) {
+		return
+	}
+
+	if input.Password != "" {
+		passwordLogin(w, r, email, input.Password, throttleKey)
+		return
+	}
+
+	ctx := r.Context()
+	var userID string
+	if err := db.QueryRowContext(ctx, "SELECT id FROM users WHERE email = $1", email).
+		Scan(&userID); err == sql.ErrNoRows {
+		// Same response as when the user exists,
+		// so nobody can find out which emails are registered.
+		w.WriteHeader(http.StatusNoContent)
+		return
+	} else if err != nil {
+		respondError(w, fmt.Errorf("could not query user to login: %v", err))
+		return
+	}
+
+	token, tokenHash, err := genToken()
+	if err != nil {
+		respondError(w, fmt.Errorf("could not generate login token: %v", err))
+		return
+	}
+
+	if _, err := db.ExecContext(ctx, `
+		INSERT INTO login_tokens (token_hash, user_id, expires_at) VALUES ($1, $2, $3)
+		RETURNING NOTHING
+	`, tokenHash, userID, time.Now().Add(loginTokenLifespan)); err != nil {
+		respondError(w, fmt.Errorf("could not insert login token: %v", err))
+		return
+	}
+
+	go sendMagicLink(email, token)
+
+	recordSecurityEvent(r, userID, eventLoginLinkSent, outcomeSuccess)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func sendMagicLink(email, token string) {
+	link := origin + "/login/callback?token=" + url.QueryEscape(token)
+	if err := mailer.Send(email, "Login to Nakama", fmt.Sprintf(
+		"Click the link below to login to Nakama.\n\n%s\n\nIt expires in %s and can be used only once.\n"+
+			"If you didn't ask for it, just ignore this email.\n",
+		link, loginTokenLifespan)); err != nil {
+		log.Printf("could not send magic link: %v\n", err)
+	}
+}
+
+func loginCallback(w http.ResponseWriter, r *http.Request) {
+	token := r.URL.Query().Get("token")
+	if token == "" {
+		http.Error(w, "Token required", http.StatusBadRequest)
+		return
+	}
 
+	ctx := r.Context()
 	var user User
-	if err := db.QueryRowContext(r.Context(), `
-		SELECT id, username, avatar_url
-		FROM users
-		WHERE email = $1
-	`, email).Scan(
-		&user.ID,
-		&user.Username,
-		&user.AvatarURL,
-	); err == sql.ErrNoRows {
-		http.Error(w,
-			http.StatusText(http.StatusNotFound),
-			http.StatusNotFound)
+	var expiresAt time.Time
+	// Deleting it right away makes the token single-use.
+	if err := db.QueryRowContext(ctx, `
+		DELETE FROM login_tokens WHERE token_hash = $1
+		RETURNING user_id, expires_at
+	`, hashToken(token)).Scan(&user.ID, &expiresAt); err == sql.ErrNoRows {
+		http.Error(w, "Invalid or used login link", http.StatusUnauthorized)
 		return
 	} else if err != nil {
+		respondError(w, fmt.Errorf("could not delete login token: %v", err))
+		return
+	}
+
+	if expiresAt.Before(time.Now()) {
+		http.Error(w, "Login link expired", http.StatusUnauthorized)
+		return
+	}
+
+	var email string
+	if err := db.QueryRowContext(ctx, "SELECT email, username, avatar_url FROM users WHERE id = $1", user.ID).
+		Scan(&email, &user.Username, &user.AvatarURL); err != nil {
 		respondError(w, fmt.Errorf("could not query user to login: %v", err))
 		return
 	}
 
-	expiresAt := time.Now().Add(year) // One year
-	tokenString, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.StandardClaims{
-		Subject:   user.ID,
-		ExpiresAt: expiresAt.Unix(),
-	}).SignedString(jwtKey)
+	// Following the link proves the email is theirs.
+	if err := markEmailVerified(ctx, db, user.ID, email); err != nil {
+		respondError(w, fmt.Errorf("could not mark email verified: %v", err))
+		return
+	}
+	userCache.Invalidate(user.ID)
+
+	completeLogin(w, r, user)
+}
+
+// completeLogin starts a new session for the given user
+// and responds with its tokens, unless the user has two-factor authentication;
+// then responds with a challenge to complete through loginTOTP.
+func completeLogin(w http.ResponseWriter, r *http.Request, user User) {
+	if rejectSuspended(w, r, user.ID) {
+		recordSecurityEvent(r, user.ID, eventLogin, outcomeFailure)
+		return
+	}
+
+	var totpEnabled bool
+	if err := db.QueryRowContext(r.Context(), "SELECT totp_enabled FROM users WHERE id = $1", user.ID).
+		Scan(&totpEnabled); err != nil {
+		respondError(w, fmt.Errorf("could not query user two-factor authentication: %v", err))
+		return
+	}
+
+	if totpEnabled {
+		recordSecurityEvent(r, user.ID, eventTOTPChallenge, outcomeSuccess)
+		respondTOTPChallenge(w, user)
+		return
+	}
+
+	startSession(w, r, user)
+}
+
+// startSession for the given user and responds with its tokens.
+func startSession(w http.ResponseWriter, r *http.Request, user User) {
+	ctx := r.Context()
+	var sessionID string
+	var refreshToken string
+	var refreshTokenExpiresAt time.Time
+	if err := crdb.ExecuteTx(ctx, db, nil, func(tx *sql.Tx) error {
+		// Logging in cancels a pending deletion.
+		if _, err := tx.Exec(`
+			UPDATE users SET delete_at = NULL
+			WHERE id = $1 AND delete_at IS NOT NULL
+			RETURNING NOTHING
+		`, user.ID); err != nil {
+			return err
+		}
+
+		var err error
+		if sessionID, err = insertSession(ctx, tx, r, user.ID); err != nil {
+			return err
+		}
+
+		refreshToken, refreshTokenExpiresAt, err = insertRefreshToken(ctx, tx, user.ID, sessionID)
+		return err
+	}); err != nil {
+		respondError(w, fmt.Errorf("could not create session: %v", err))
+		return
+	}
+
+	recordSecurityEvent(r, user.ID, eventLogin, outcomeSuccess)
+
+	respondTokens(w, user, sessionID, refreshToken, refreshTokenExpiresAt)
+}
+
+// respondTokens issues an access JWT, sets it as a cookie along with
+// the given refresh token and responds with both.
+func respondTokens(w http.ResponseWriter, user User, sessionID, refreshToken string, refreshTokenExpiresAt time.Time) {
+	expiresAt := time.Now().Add(accessTokenLifespan)
+	tokenString, err := keyRing.Sign(Claims{
+		StandardClaims: jwt.StandardClaims{
+			Id:        sessionID,
+			Issuer:    origin,
+			Subject:   user.ID,
+			ExpiresAt: expiresAt.Unix(),
+		},
+		TokenType: accessTokenType,
+	})
 	if err != nil {
 		respondError(w, fmt.Errorf("could not generate JWT: %v", err))
 		return
 	}
 
-	http.SetCookie(w, &http.Cookie{
-		Name:    "jwt",
-		Value:   tokenString,
-		Path:    "/",
-		Expires: expiresAt,
-		// Secure:   true,
-	})
-	respondJSON(w, LoginPayload{user, tokenString, expiresAt}, http.StatusOK)
+	if err := setCSRFCookie(w, refreshTokenExpiresAt); err != nil {
+		respondError(w, fmt.Errorf("could not generate CSRF token: %v", err))
+		return
+	}
+
+	setCookie(w, "jwt", tokenString, "/", expiresAt, true)
+	setCookie(w, "refresh_token", refreshToken, "/api", refreshTokenExpiresAt, true)
+	respondJSON(w, LoginPayload{
+		User:                  user,
+		JWT:                   tokenString,
+		ExpiresAt:             expiresAt,
+		RefreshToken:          refreshToken,
+		RefreshTokenExpiresAt: refreshTokenExpiresAt,
+	}, http.StatusOK)
+}
+
+// genToken generates a random URL safe token along with its hash.
+// Only the hash should be stored.
+func genToken() (string, []byte, error) {
+	token, err := randomString()
+	if err != nil {
+		return "", nil, err
+	}
+	return token, hashToken(token), nil
+}
+
+func randomString() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func hashToken(token string) []byte {
+	h := sha256.Sum256([]byte(token))
+	return h[:]
 }
 
 func logout(w http.ResponseWriter, r *http.Request) {
-	http.SetCookie(w, &http.Cookie{
-		Name:   "jwt",
-		Value:  "",
-		Path:   "/",
-		MaxAge: -1,
-	})
+	if c, err := r.Cookie("refresh_token"); err == nil {
+		ctx := r.Context()
+		var sessionID, userID string
+		if err := db.QueryRowContext(ctx, "SELECT session_id, user_id FROM refresh_tokens WHERE token_hash = $1", hashToken(c.Value)).
+			Scan(&sessionID, &userID); err != nil && err != sql.ErrNoRows {
+			respondError(w, fmt.Errorf("could not query session to logout: %v", err))
+			return
+		} else if err == nil {
+			if err := revokeSession(ctx, db, sessionID); err != nil {
+				respondError(w, fmt.Errorf("could not revoke session: %v", err))
+				return
+			}
+
+			recordSecurityEvent(r, userID, eventLogout, outcomeSuccess)
+		}
+	}
+
+	clearAuthCookies(w)
 	w.WriteHeader(http.StatusNoContent)
 }
 
+func clearAuthCookies(w http.ResponseWriter) {
+	expireCookie(w, "refresh_token", "/api")
+	expireCookie(w, "jwt", "/")
+	expireCookie(w, csrfCookieName, "/")
+}
+
 func maybeAuthUserID(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		var tokenString string
-		if a := r.Header.Get("Authorization"); strings.HasPrefix(a, "Bearer ") {
+		if a := r.Header.Get("Authorization"); strings.HasPrefix(a, "Bearer "+personalTokenPrefix) {
+			personalTokenMiddleware(next, w, r, a[7:])
+			return
+		} else if strings.HasPrefix(a, "Bearer ") {
 			tokenString = a[7:]
 		} else if c, err := r.Cookie("jwt"); err == nil {
+			// Browsers send cookies along with cross-site requests too.
+			if !validCSRF(r) {
+				http.Error(w, "Invalid CSRF token", http.StatusForbidden)
+				return
+			}
 			tokenString = c.Value
 		} else {
 			next.ServeHTTP(w, r)
 			return
 		}
 
-		p := jwt.Parser{ValidMethods: []string{jwt.SigningMethodHS256.Name}}
-		token, err := p.ParseWithClaims(tokenString, &jwt.StandardClaims{}, jwtKeyfunc)
+		p := jwt.Parser{ValidMethods: keyRing.ValidMethods()}
+		token, err := p.ParseWithClaims(tokenString, &Claims{}, keyRing.Keyfunc)
 		if err != nil {
 			http.Error(w,
 				http.StatusText(http.StatusUnauthorized),
@@ -122,8 +348,10 @@ func maybeAuthUserID(next http.Handler) http.Handler {
 			return
 		}
 
-		claims, ok := token.Claims.(*jwt.StandardClaims)
-		if !ok || !token.Valid {
+		// Only access tokens are accepted.
+		// That also rules out the old long-lived tokens without type.
+		claims, ok := token.Claims.(*Claims)
+		if !ok || !token.Valid || claims.TokenType != accessTokenType {
 			http.Error(w,
 				http.StatusText(http.StatusUnauthorized),
 				http.StatusUnauthorized)
@@ -131,13 +359,68 @@ func maybeAuthUserID(next http.Handler) http.Handler {
 		}
 
 		authUserID := claims.Subject
+		sessionID := claims.Id
 		ctx := r.Context()
+
+		// The session could have been revoked since the token was issued,
+		// and the user suspended.
+		var lastSeenAt time.Time
+		var suspended bool
+		if err := db.QueryRowContext(ctx, `
+			SELECT sessions.last_seen_at, `+sqlUserSuspended+`
+			FROM sessions
+			INNER JOIN users ON sessions.user_id = users.id
+			WHERE sessions.id = $1::UUID AND sessions.user_id = $2 AND sessions.expires_at > now()
+		`, sessionID, authUserID).Scan(&lastSeenAt, &suspended); err == sql.ErrNoRows {
+			http.Error(w,
+				http.StatusText(http.StatusUnauthorized),
+				http.StatusUnauthorized)
+			return
+		} else if err != nil {
+			respondError(w, fmt.Errorf("could not query session: %v", err))
+			return
+		}
+
+		if suspended && rejectSuspended(w, r, authUserID) {
+			return
+		}
+
+		if time.Since(lastSeenAt) > sessionTouchInterval {
+			go touchSession(sessionID, clientIP(r))
+		}
+
 		ctx = context.WithValue(ctx, keyAuthUserID, authUserID)
+		ctx = context.WithValue(ctx, keySessionID, sessionID)
 
 		next.ServeHTTP(w, r.WithContext(ctx))
 	})
 }
 
+// personalTokenMiddleware authenticates with a personal token.
+// Its scopes go in the context for requireScope to check.
+func personalTokenMiddleware(next http.Handler, w http.ResponseWriter, r *http.Request, token string) {
+	ctx := r.Context()
+	authUserID, scopes, suspended, err := personalTokenAuth(ctx, token)
+	if err == sql.ErrNoRows {
+		http.Error(w,
+			http.StatusText(http.StatusUnauthorized),
+			http.StatusUnauthorized)
+		return
+	} else if err != nil {
+		respondError(w, fmt.Errorf("could not query personal token: %v", err))
+		return
+	}
+
+	if suspended && rejectSuspended(w, r, authUserID) {
+		return
+	}
+
+	ctx = context.WithValue(ctx, keyAuthUserID, authUserID)
+	ctx = context.WithValue(ctx, keyAuthScopes, scopes)
+
+	next.ServeHTTP(w, r.WithContext(ctx))
+}
+
 func mustAuthUser(next http.Handler) http.Handler {
 	return maybeAuthUserID(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		ctx := r.Context()
@@ -151,18 +434,38 @@ func mustAuthUser(next http.Handler) http.Handler {
 		}
 
 		var authUser User
-		if err := db.QueryRowContext(ctx, "SELECT username, avatar_url FROM users WHERE id = $1", authUserID).
-			Scan(&authUser.Username, &authUser.AvatarURL); err == sql.ErrNoRows {
-			http.Error(w,
-				http.StatusText(http.StatusTeapot),
-				http.StatusTeapot)
-			return
-		} else if err != nil {
-			respondError(w, fmt.Errorf("could not query authenticated user: %v", err))
+		if v, cached := userCache.Get(authUserID); cached {
+			authUser = v.(User)
+		} else {
+			if err := db.QueryRowContext(ctx, `
+				SELECT username, avatar_url, role, email_verified_at IS NOT NULL
+				FROM users WHERE id = $1
+			`, authUserID).Scan(
+				&authUser.Username,
+				&authUser.AvatarURL,
+				&authUser.Role,
+				&authUser.EmailVerified,
+			); err == sql.ErrNoRows {
+				http.Error(w,
+					http.StatusText(http.StatusTeapot),
+					http.StatusTeapot)
+				return
+			} else if err != nil {
+				respondError(w, fmt.Errorf("could not query authenticated user: %v", err))
+				return
+			}
+
+			authUser.ID = authUserID
+			userCache.Set(authUserID, authUser)
+		}
+
+		// Unverified users can read but not write,
+		// except on the routes that opt in, like managing the account.
+		if _, allowed := ctx.Value(keyAllowUnverified).(bool); !authUser.EmailVerified && !allowed && !isSafeMethod(r.Method) {
+			http.Error(w, "Email not verified", http.StatusForbidden)
 			return
 		}
 
-		authUser.ID = authUserID
 		ctx = context.WithValue(ctx, keyAuthUser, authUser)
 
 		next.ServeHTTP(w, r.WithContext(ctx))
@@ -0,0 +1,323 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	_ "image/gif" // registers the GIF decoder
+	"image/jpeg"
+	_ "image/png" // registers the PNG decoder
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// UpdateAvatarPayload response body
+type UpdateAvatarPayload struct {
+	AvatarURL string `json:"avatarUrl"`
+}
+
+const (
+	maxAvatarSize      = 5 << 20
+	maxAvatarDimension = 4096
+	avatarJPEGQuality  = 85
+)
+
+// avatarSizes of the square thumbnails, from biggest to smallest.
+// avatar_url points to the biggest;
+// the others replace its size suffix, like "-64.jpg".
+var avatarSizes = []int{256, 128, 64}
+
+var avatarContentTypes = map[string]bool{
+	"image/jpeg": true,
+	"image/png":  true,
+	"image/gif":  true,
+}
+
+func updateAvatar(w http.ResponseWriter, r *http.Request) {
+	// Some room for the multipart boundaries and headers.
+	r.Body = http.MaxBytesReader(w, r.Body, maxAvatarSize+1<<10)
+	file, _, err := r.FormFile("avatar")
+	if err != nil {
+		http.Error(w, "Avatar file required", http.StatusBadRequest)
+		return
+	}
+	defer file.Close()
+
+	data, err := ioutil.ReadAll(io.LimitReader(file, maxAvatarSize+1))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if len(data) > maxAvatarSize {
+		http.Error(w, fmt.Sprintf("Avatar must be at most %dMB", maxAvatarSize>>20), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	// The declared type can't be trusted; look at the content.
+	if !avatarContentTypes[http.DetectContentType(data)] {
+		http.Error(w, "Only JPEG, PNG and GIF avatars allowed", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	// Checked before decoding, so a small file can't blow up in memory.
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil || config.Width > maxAvatarDimension || config.Height > maxAvatarDimension {
+		respondJSON(w, map[string]string{
+			"avatar": fmt.Sprintf("Avatar must be a valid image of at most %dx%d pixels", maxAvatarDimension, maxAvatarDimension),
+		}, http.StatusUnprocessableEntity)
+		return
+	}
+
+	// Read before decoding, which ignores it, and applied before cropping,
+	// or phone photos would end up sideways.
+	orientation := jpegOrientation(data)
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		respondJSON(w, map[string]string{
+			"avatar": "Avatar must be a valid image",
+		}, http.StatusUnprocessableEntity)
+		return
+	}
+	img = orient(img, orientation)
+
+	random, err := randomString()
+	if err != nil {
+		respondError(w, fmt.Errorf("could not generate avatar name: %v", err))
+		return
+	}
+
+	// Re-encoding leaves EXIF and any other metadata behind.
+	ctx := r.Context()
+	thumbnail := img
+	for _, size := range avatarSizes {
+		thumbnail = squareThumbnail(thumbnail, size)
+
+		var buf bytes.Buffer
+		if err := jpeg.Encode(&buf, thumbnail, &jpeg.Options{Quality: avatarJPEGQuality}); err != nil {
+			respondError(w, fmt.Errorf("could not encode avatar: %v", err))
+			return
+		}
+
+		if err := storage.Put(ctx, avatarName(random, size), buf.Bytes(), "image/jpeg"); err != nil {
+			respondError(w, fmt.Errorf("could not store avatar: %v", err))
+			return
+		}
+	}
+
+	authUserID := ctx.Value(keyAuthUserID).(string)
+	avatarURL := storage.URL(avatarName(random, avatarSizes[0]))
+
+	var oldAvatarURL *string
+	if err := db.QueryRowContext(ctx, "SELECT avatar_url FROM users WHERE id = $1", authUserID).
+		Scan(&oldAvatarURL); err != nil {
+		respondError(w, fmt.Errorf("could not query old avatar: %v", err))
+		return
+	}
+
+	if _, err := db.ExecContext(ctx, `
+		UPDATE users SET avatar_url = $1
+		WHERE id = $2
+		RETURNING NOTHING
+	`, avatarURL, authUserID); err != nil {
+		respondError(w, fmt.Errorf("could not update avatar: %v", err))
+		return
+	}
+
+	userCache.Invalidate(authUserID)
+
+	if oldAvatarURL != nil {
+		go deleteAvatar(*oldAvatarURL)
+	}
+
+	respondJSON(w, UpdateAvatarPayload{avatarURL}, http.StatusOK)
+}
+
+func avatarName(random string, size int) string {
+	return random + "-" + strconv.Itoa(size) + ".jpg"
+}
+
+// deleteAvatar removes every size of the avatar at the given URL.
+func deleteAvatar(avatarURL string) {
+	suffix := "-" + strconv.Itoa(avatarSizes[0]) + ".jpg"
+	i := strings.LastIndex(avatarURL, "/")
+	if i == -1 || !strings.HasSuffix(avatarURL, suffix) {
+		return
+	}
+
+	random := strings.TrimSuffix(avatarURL[i+1:], suffix)
+	for _, size := range avatarSizes {
+		if err := storage.Delete(context.Background(), avatarName(random, size)); err != nil {
+			log.Printf("could not delete avatar: %v\n", err)
+		}
+	}
+}
+
+// jpegOrientation reads the EXIF orientation of a JPEG, from 1 to 8.
+// It's 1, upright, for other images or when missing.
+func jpegOrientation(data []byte) int {
+	if len(data) < 2 || data[0] != 0xFF || data[1] != 0xD8 {
+		return 1
+	}
+
+	for i := 2; i+4 <= len(data); {
+		if data[i] != 0xFF {
+			return 1
+		}
+
+		marker := data[i+1]
+		switch {
+		case marker == 0xFF: // Fill byte.
+			i++
+			continue
+		case marker == 0x01 || marker >= 0xD0 && marker <= 0xD8: // No length.
+			i += 2
+			continue
+		case marker == 0xD9 || marker == 0xDA: // Metadata comes before the image data.
+			return 1
+		}
+
+		size := int(binary.BigEndian.Uint16(data[i+2:]))
+		if size < 2 || i+2+size > len(data) {
+			return 1
+		}
+
+		segment := data[i+4 : i+2+size]
+		if marker == 0xE1 && bytes.HasPrefix(segment, []byte("Exif\x00\x00")) {
+			return exifOrientation(segment[6:])
+		}
+
+		i += 2 + size
+	}
+
+	return 1
+}
+
+// exifOrientation finds the orientation tag in the first IFD of the TIFF data.
+func exifOrientation(tiff []byte) int {
+	if len(tiff) < 8 {
+		return 1
+	}
+
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 1
+	}
+
+	offset := int64(order.Uint32(tiff[4:]))
+	if offset < 8 || offset+2 > int64(len(tiff)) {
+		return 1
+	}
+
+	entries := int64(order.Uint16(tiff[offset:]))
+	for i := int64(0); i < entries; i++ {
+		entry := offset + 2 + i*12
+		if entry+12 > int64(len(tiff)) {
+			return 1
+		}
+
+		if order.Uint16(tiff[entry:]) == 0x0112 {
+			if o := int(order.Uint16(tiff[entry+8:])); o >= 1 && o <= 8 {
+				return o
+			}
+			return 1
+		}
+	}
+
+	return 1
+}
+
+// orient turns and flips img upright as of its EXIF orientation.
+func orient(img image.Image, orientation int) image.Image {
+	if orientation <= 1 || orientation > 8 {
+		return img
+	}
+
+	bounds := img.Bounds()
+	w, h := bounds.Dx(), bounds.Dy()
+	// Orientations 5 to 8 swap width and height.
+	dw, dh := w, h
+	if orientation >= 5 {
+		dw, dh = h, w
+	}
+
+	dst := image.NewRGBA64(image.Rect(0, 0, dw, dh))
+	for y := 0; y < dh; y++ {
+		for x := 0; x < dw; x++ {
+			var sx, sy int
+			switch orientation {
+			case 2: // Mirrored.
+				sx, sy = w-1-x, y
+			case 3: // Upside down.
+				sx, sy = w-1-x, h-1-y
+			case 4: // Upside down and mirrored.
+				sx, sy = x, h-1-y
+			case 5: // Turned left and mirrored.
+				sx, sy = y, x
+			case 6: // Turned left.
+				sx, sy = y, h-1-x
+			case 7: // Turned right and mirrored.
+				sx, sy = w-1-y, h-1-x
+			case 8: // Turned right.
+				sx, sy = w-1-y, x
+			}
+			dst.Set(x, y, img.At(bounds.Min.X+sx, bounds.Min.Y+sy))
+		}
+	}
+	return dst
+}
+
+// squareThumbnail crops the center square of src and scales it to size,
+// averaging the pixels each one covers.
+// Transparent areas end up white, since JPEG has no alpha.
+func squareThumbnail(src image.Image, size int) image.Image {
+	bounds := src.Bounds()
+	side := bounds.Dx()
+	if bounds.Dy() < side {
+		side = bounds.Dy()
+	}
+	x0 := bounds.Min.X + (bounds.Dx()-side)/2
+	y0 := bounds.Min.Y + (bounds.Dy()-side)/2
+
+	scaled := image.NewRGBA64(image.Rect(0, 0, size, size))
+	for y := 0; y < size; y++ {
+		sy0, sy1 := y0+y*side/size, y0+(y+1)*side/size
+		if sy1 == sy0 {
+			sy1++
+		}
+		for x := 0; x < size; x++ {
+			sx0, sx1 := x0+x*side/size, x0+(x+1)*side/size
+			if sx1 == sx0 {
+				sx1++
+			}
+
+			var r, g, b, a, n uint64
+			for sy := sy0; sy < sy1; sy++ {
+				for sx := sx0; sx < sx1; sx++ {
+					cr, cg, cb, ca := src.At(sx, sy).RGBA()
+					r, g, b, a = r+uint64(cr), g+uint64(cg), b+uint64(cb), a+uint64(ca)
+					n++
+				}
+			}
+			scaled.SetRGBA64(x, y, color.RGBA64{uint16(r / n), uint16(g / n), uint16(b / n), uint16(a / n)})
+		}
+	}
+
+	dst := image.NewRGBA(scaled.Bounds())
+	draw.Draw(dst, dst.Bounds(), image.White, image.Point{}, draw.Src)
+	draw.Draw(dst, dst.Bounds(), scaled, image.Point{}, draw.Over)
+	return dst
+}
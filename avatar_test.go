@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"testing"
+)
+
+// exifJPEG encodes img as a JPEG with an EXIF orientation right after the SOI marker.
+func exifJPEG(t *testing.T, img image.Image, order binary.ByteOrder, orientation uint16) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	tiff := make([]byte, 8+2+12+4)
+	if order == binary.LittleEndian {
+		copy(tiff, "II")
+	} else {
+		copy(tiff, "MM")
+	}
+	order.PutUint16(tiff[2:], 42)
+	order.PutUint32(tiff[4:], 8)
+	order.PutUint16(tiff[8:], 1)
+	order.PutUint16(tiff[10:], 0x0112)
+	order.PutUint16(tiff[12:], 3) // SHORT
+	order.PutUint32(tiff[14:], 1)
+	order.PutUint16(tiff[18:], orientation)
+
+	segment := append([]byte("Exif\x00\x00"), tiff...)
+	app1 := []byte{0xFF, 0xE1, 0, 0}
+	binary.BigEndian.PutUint16(app1[2:], uint16(len(segment)+2))
+
+	data := buf.Bytes()
+	out := append([]byte{}, data[:2]...)
+	out = append(out, app1...)
+	out = append(out, segment...)
+	return append(out, data[2:]...)
+}
+
+func TestJPEGOrientation(t *testing.T) {
+	img := image.NewGray(image.Rect(0, 0, 8, 8))
+	for _, order := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+		for o := uint16(1); o <= 8; o++ {
+			if got := jpegOrientation(exifJPEG(t, img, order, o)); got != int(o) {
+				t.Errorf("%v orientation %d: got %d", order, o, got)
+			}
+		}
+	}
+
+	var plain bytes.Buffer
+	if err := jpeg.Encode(&plain, img, nil); err != nil {
+		t.Fatal(err)
+	}
+	if got := jpegOrientation(plain.Bytes()); got != 1 {
+		t.Errorf("without EXIF: got %d, want 1", got)
+	}
+	if got := jpegOrientation([]byte("not an image")); got != 1 {
+		t.Errorf("not a JPEG: got %d, want 1", got)
+	}
+}
+
+func TestOrient(t *testing.T) {
+	// 2x1: red on the left, blue on the right.
+	red := color.RGBA{255, 0, 0, 255}
+	blue := color.RGBA{0, 0, 255, 255}
+	src := image.NewRGBA(image.Rect(0, 0, 2, 1))
+	src.Set(0, 0, red)
+	src.Set(1, 0, blue)
+
+	tests := []struct {
+		orientation int
+		want        [][]color.RGBA // Rows of the result.
+	}{
+		{1, [][]color.RGBA{{red, blue}}},
+		{2, [][]color.RGBA{{blue, red}}},
+		{3, [][]color.RGBA{{blue, red}}},
+		{4, [][]color.RGBA{{red, blue}}},
+		{5, [][]color.RGBA{{red}, {blue}}},
+		{6, [][]color.RGBA{{red}, {blue}}},
+		{7, [][]color.RGBA{{blue}, {red}}},
+		{8, [][]color.RGBA{{blue}, {red}}},
+	}
+	for _, tt := range tests {
+		got := orient(src, tt.orientation)
+		if b := got.Bounds(); b.Dx() != len(tt.want[0]) || b.Dy() != len(tt.want) {
+			t.Errorf("orientation %d: got %dx%d", tt.orientation, b.Dx(), b.Dy())
+			continue
+		}
+		for y, row := range tt.want {
+			for x, want := range row {
+				if c := color.RGBAModel.Convert(got.At(x, y)).(color.RGBA); c != want {
+					t.Errorf("orientation %d at %d,%d: got %v, want %v", tt.orientation, x, y, c, want)
+				}
+			}
+		}
+	}
+}
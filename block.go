@@ -0,0 +1,122 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/cockroachdb/cockroach-go/crdb"
+	"github.com/go-chi/chi"
+)
+
+var (
+	errBlockingMyself = errors.New("Try blocking someone else")
+	errBlocked        = errors.New("Blocked")
+)
+
+// sqlNotBlocked is true when neither of the given users blocked the other.
+func sqlNotBlocked(a, b string) string {
+	return `NOT EXISTS (
+		SELECT 1 FROM blocks
+		WHERE (blocker_id = ` + a + ` AND blocked_id = ` + b + `)
+			OR (blocker_id = ` + b + ` AND blocked_id = ` + a + `)
+	)`
+}
+
+// isBlocked tells whether either of the users blocked the other.
+func isBlocked(tx *sql.Tx, userID, otherUserID string) (bool, error) {
+	var blocked bool
+	err := tx.QueryRow(`SELECT NOT `+sqlNotBlocked("$1", "$2"), userID, otherUserID).
+		Scan(&blocked)
+	return blocked, err
+}
+
+// blockUser stops the users from following each other
+// and hides what each one posts and comments from the other.
+func blockUser(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	authUserID := ctx.Value(keyAuthUserID).(string)
+	username := chi.URLParam(r, "username")
+
+	var userID string
+	if err := crdb.ExecuteTx(ctx, db, nil, func(tx *sql.Tx) error {
+		if err := tx.QueryRow("SELECT id FROM users WHERE username = $1", username).
+			Scan(&userID); err != nil {
+			return err
+		}
+
+		if userID == authUserID {
+			return errBlockingMyself
+		}
+
+		if _, err := tx.Exec(`
+			INSERT INTO blocks (blocker_id, blocked_id) VALUES ($1, $2)
+			ON CONFLICT (blocker_id, blocked_id) DO NOTHING
+			RETURNING NOTHING
+		`, authUserID, userID); err != nil {
+			return err
+		}
+
+		for _, pair := range [][2]string{{authUserID, userID}, {userID, authUserID}} {
+			var following bool
+			if err := tx.QueryRow(`SELECT EXISTS (
+				SELECT 1 FROM follows
+				WHERE follower_id = $1
+					AND following_id = $2
+			)`, pair[0], pair[1]).Scan(&following); err != nil {
+				return err
+			}
+
+			if following {
+				if _, err := deleteFollow(tx, pair[0], pair[1]); err != nil {
+					return err
+				}
+			}
+		}
+
+		_, err := tx.Exec(`
+			DELETE FROM follow_requests
+			WHERE (follower_id = $1 AND following_id = $2)
+				OR (follower_id = $2 AND following_id = $1)
+			RETURNING NOTHING
+		`, authUserID, userID)
+		return err
+	}); err == sql.ErrNoRows {
+		http.Error(w,
+			http.StatusText(http.StatusNotFound),
+			http.StatusNotFound)
+		return
+	} else if err == errBlockingMyself {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	} else if err != nil {
+		respondError(w, fmt.Errorf("could not block user: %v", err))
+		return
+	}
+
+	recordSecurityEvent(r, authUserID, eventBlock, outcomeSuccess)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// unblockUser lifts the block. Follows removed by it are not restored.
+func unblockUser(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	authUserID := ctx.Value(keyAuthUserID).(string)
+	username := chi.URLParam(r, "username")
+
+	if _, err := db.ExecContext(ctx, `
+		DELETE FROM blocks
+		WHERE blocker_id = $1
+			AND blocked_id = (SELECT id FROM users WHERE username = $2)
+		RETURNING NOTHING
+	`, authUserID, username); err != nil {
+		respondError(w, fmt.Errorf("could not unblock user: %v", err))
+		return
+	}
+
+	recordSecurityEvent(r, authUserID, eventUnblock, outcomeSuccess)
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"expvar"
+	"sync"
+	"time"
+)
+
+// Cache keeps values in memory for a while,
+// so mustAuthUser doesn't query the user on every request.
+// Whatever changes a cached value must invalidate it.
+type Cache struct {
+	TTL time.Duration
+
+	mu      sync.Mutex
+	entries expiringMap
+	hits    *expvar.Int
+	misses  *expvar.Int
+}
+
+// expiringMap is a map whose entries expire,
+// swept from time to time as new ones are set.
+// Cache and MemoryThrottleStore build on it, guarding it with their own locks.
+type expiringMap struct {
+	entries   map[string]expiringEntry
+	lastSweep time.Time
+}
+
+type expiringEntry struct {
+	value     interface{}
+	expiresAt time.Time
+}
+
+const sweepInterval = time.Minute
+
+var userCache = NewCache("user_cache", time.Minute)
+
+// NewCache creates an empty Cache publishing its metrics with expvar,
+// prefixed with name.
+func NewCache(name string, ttl time.Duration) *Cache {
+	c := &Cache{
+		TTL:    ttl,
+		hits:   expvar.NewInt(name + "_hits"),
+		misses: expvar.NewInt(name + "_misses"),
+	}
+	expvar.Publish(name+"_hit_rate", expvar.Func(func() interface{} {
+		hits, misses := c.hits.Value(), c.misses.Value()
+		if hits+misses == 0 {
+			return 0.0
+		}
+		return float64(hits) / float64(hits+misses)
+	}))
+	return c
+}
+
+// Get the value of key.
+func (c *Cache) Get(key string) (interface{}, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	value, ok := c.entries.get(key, time.Now())
+	if !ok {
+		c.misses.Add(1)
+		return nil, false
+	}
+	c.hits.Add(1)
+	return value, true
+}
+
+// Set the value of key.
+func (c *Cache) Set(key string, value interface{}) {
+	if c.TTL <= 0 {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	c.entries.set(key, value, now.Add(c.TTL), now)
+}
+
+// Invalidate the value of key.
+func (c *Cache) Invalidate(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.entries.delete(key)
+}
+
+func (m *expiringMap) get(key string, now time.Time) (interface{}, bool) {
+	e, ok := m.entries[key]
+	if !ok || now.After(e.expiresAt) {
+		return nil, false
+	}
+	return e.value, true
+}
+
+func (m *expiringMap) set(key string, value interface{}, expiresAt, now time.Time) {
+	if m.entries == nil {
+		m.entries = map[string]expiringEntry{}
+	}
+
+	if now.Sub(m.lastSweep) > sweepInterval {
+		for k, e := range m.entries {
+			if now.After(e.expiresAt) {
+				delete(m.entries, k)
+			}
+		}
+		m.lastSweep = now
+	}
+
+	m.entries[key] = expiringEntry{value, expiresAt}
+}
+
+func (m *expiringMap) delete(key string) {
+	delete(m.entries, key)
+}
@@ -52,6 +52,10 @@ func createComment(w http.ResponseWriter, r *http.Request) {
 
 	var comment Comment
 	if err := crdb.ExecuteTx(ctx, db, nil, func(tx *sql.Tx) error {
+		if err := checkPostVisible(tx, postID, authUser.ID); err != nil {
+			return err
+		}
+
 		if err := tx.QueryRow(`
 			INSERT INTO comments (content, user_id, post_id) VALUES ($1, $2, $3)
 			RETURNING id, created_at
@@ -73,7 +77,12 @@ func createComment(w http.ResponseWriter, r *http.Request) {
 			RETURNING NOTHING
 		`, postID)
 		return err
-	}); err != nil {
+	}); err == sql.ErrNoRows {
+		http.Error(w,
+			http.StatusText(http.StatusNotFound),
+			http.StatusNotFound)
+		return
+	} else if err != nil {
 		respondError(w, fmt.Errorf("could not create comment: %v", err))
 		return
 	}
@@ -107,7 +116,9 @@ func getComments(w http.ResponseWriter, r *http.Request) {
 			users.username,
 			users.avatar_url`
 	args := []interface{}{postID}
+	visibleTo := ""
 	if authenticated {
+		visibleTo = "$2"
 		query += `,
 			comments.user_id = $2 AS mine,
 			likes.user_id IS NOT NULL AS liked`
@@ -123,6 +134,17 @@ func getComments(w http.ResponseWriter, r *http.Request) {
 	}
 	query += `
 		WHERE comments.post_id = $1
+			AND NOT ` + sqlUserSuspended + `
+			AND EXISTS (
+				SELECT 1 FROM posts
+				INNER JOIN users ON posts.user_id = users.id
+				WHERE posts.id = $1 AND ` + sqlUserVisibleTo(visibleTo) + `
+			)`
+	if authenticated {
+		query += `
+			AND ` + sqlNotBlocked("$2", "users.id")
+	}
+	query += `
 		ORDER BY comments.created_at DESC`
 
 	rows, err := db.QueryContext(ctx, query, args...)
@@ -175,6 +197,23 @@ func toggleCommentLike(w http.ResponseWriter, r *http.Request) {
 	var liked bool
 	var likesCount int
 	if err := crdb.ExecuteTx(ctx, db, nil, func(tx *sql.Tx) error {
+		var postID, commentUserID string
+		if err := tx.QueryRow("SELECT post_id, user_id FROM comments WHERE id = $1", commentID).
+			Scan(&postID, &commentUserID); err != nil {
+			return err
+		}
+
+		if err := checkPostVisible(tx, postID, authUserID); err != nil {
+			return err
+		}
+
+		// Comments of blocked users are hidden even on posts of others.
+		if blocked, err := isBlocked(tx, authUserID, commentUserID); err != nil {
+			return err
+		} else if blocked {
+			return sql.ErrNoRows
+		}
+
 		if err := tx.QueryRow(`SELECT EXISTS (
 			SELECT 1 FROM comment_likes
 			WHERE user_id = $1 AND comment_id = $2
@@ -210,7 +249,12 @@ func toggleCommentLike(w http.ResponseWriter, r *http.Request) {
 			WHERE id = $1
 			RETURNING likes_count
 		`, commentID).Scan(&likesCount)
-	}); err != nil {
+	}); err == sql.ErrNoRows {
+		http.Error(w,
+			http.StatusText(http.StatusNotFound),
+			http.StatusNotFound)
+		return
+	} else if err != nil {
 		respondError(w, fmt.Errorf("could not toggle comment like: %v", err))
 		return
 	}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	csrfCookieName = "csrf_token"
+	csrfHeaderName = "X-CSRF-Token"
+)
+
+// Cookie attributes are configurable so they can be relaxed for development.
+// Secure defaults to whether the origin is served over https.
+var (
+	cookieSecure   = env("COOKIE_SECURE", boolString(strings.HasPrefix(origin, "https://"))) == "true"
+	cookieSameSite = parseSameSite(env("COOKIE_SAMESITE", "lax"))
+)
+
+func boolString(b bool) string {
+	if b {
+		return "true"
+	}
+	return "false"
+}
+
+func parseSameSite(s string) http.SameSite {
+	switch strings.ToLower(s) {
+	case "strict":
+		return http.SameSiteStrictMode
+	case "none":
+		return http.SameSiteNoneMode
+	default:
+		return http.SameSiteLaxMode
+	}
+}
+
+// setCookie with the configured security attributes.
+func setCookie(w http.ResponseWriter, name, value, path string, expires time.Time, httpOnly bool) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     path,
+		Expires:  expires,
+		HttpOnly: httpOnly,
+		Secure:   cookieSecure,
+		SameSite: cookieSameSite,
+	})
+}
+
+func expireCookie(w http.ResponseWriter, name, path string) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     name,
+		Value:    "",
+		Path:     path,
+		MaxAge:   -1,
+		Secure:   cookieSecure,
+		SameSite: cookieSameSite,
+	})
+}
+
+// setCSRFCookie with a new random token.
+// It is readable by scripts so the frontend can send it back in the header;
+// a cross-site form can't.
+func setCSRFCookie(w http.ResponseWriter, expires time.Time) error {
+	token, err := randomString()
+	if err != nil {
+		return err
+	}
+
+	setCookie(w, csrfCookieName, token, "/", expires, false)
+	return nil
+}
+
+func isSafeMethod(method string) bool {
+	return method == http.MethodGet || method == http.MethodHead || method == http.MethodOptions
+}
+
+// validCSRF checks the double submitted token of a state-changing request.
+func validCSRF(r *http.Request) bool {
+	if isSafeMethod(r.Method) {
+		return true
+	}
+
+	c, err := r.Cookie(csrfCookieName)
+	if err != nil || c.Value == "" {
+		return false
+	}
+
+	return subtle.ConstantTimeCompare([]byte(c.Value), []byte(r.Header.Get(csrfHeaderName))) == 1
+}
+
+// csrfProtect rejects state-changing requests authenticated with cookies
+// but without a valid CSRF token.
+// Requests without cookies, like bearer ones, aren't exposed to CSRF.
+func csrfProtect(cookieName string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if _, err := r.Cookie(cookieName); err == nil && !validCSRF(r) {
+				http.Error(w, "Invalid CSRF token", http.StatusForbidden)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
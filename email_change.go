@@ -0,0 +1,238 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/cockroachdb/cockroach-go/crdb"
+	"github.com/lib/pq"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// ChangeEmailInput request body
+type ChangeEmailInput struct {
+	Email    string `json:"email"`
+	Password string `json:"password,omitempty"`
+}
+
+// EmailChangeTokenInput request body
+type EmailChangeTokenInput struct {
+	Token string `json:"token"`
+}
+
+const emailChangeTokenLifespan = time.Hour * 24
+
+// changeEmail starts an email change.
+// It only applies once confirmed from the new address,
+// and the old one gets a link to cancel it.
+// Registered addresses get the link too, so the response doesn't tell them apart;
+// confirming fails then.
+func changeEmail(w http.ResponseWriter, r *http.Request) {
+	var input ChangeEmailInput
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer r.Body.Close()
+
+	newEmail := strings.TrimSpace(input.Email)
+	if !rxEmail.MatchString(newEmail) {
+		respondJSON(w, map[string]string{
+			"email": "Invalid email",
+		}, http.StatusUnprocessableEntity)
+		return
+	}
+
+	ctx := r.Context()
+	authUserID := ctx.Value(keyAuthUserID).(string)
+
+	throttleKey := "change_email:user:" + authUserID
+	if throttled(w, loginThrottler, throttleKey) {
+		return
+	}
+
+	var oldEmail string
+	var passwordHash []byte
+	if err := db.QueryRowContext(ctx, "SELECT email, password_hash FROM users WHERE id = $1", authUserID).
+		Scan(&oldEmail, &passwordHash); err != nil {
+		respondError(w, fmt.Errorf("could not query user to change email: %v", err))
+		return
+	}
+
+	// Users without password already proved they own the old address to login.
+	if passwordHash != nil && bcrypt.CompareHashAndPassword(passwordHash, []byte(input.Password)) != nil {
+		recordSecurityEvent(r, authUserID, eventEmailChangeRequested, outcomeFailure)
+		respondJSON(w, map[string]string{
+			"password": "Wrong password",
+		}, http.StatusUnprocessableEntity)
+		return
+	}
+
+	if strings.EqualFold(newEmail, oldEmail) {
+		respondJSON(w, map[string]string{
+			"email": "Same as the current email",
+		}, http.StatusUnprocessableEntity)
+		return
+	}
+
+	token, tokenHash, err := genToken()
+	if err != nil {
+		respondError(w, fmt.Errorf("could not generate email change token: %v", err))
+		return
+	}
+
+	cancelToken, cancelTokenHash, err := genToken()
+	if err != nil {
+		respondError(w, fmt.Errorf("could not generate email change cancel token: %v", err))
+		return
+	}
+
+	// Only the last requested change is pending.
+	if err := crdb.ExecuteTx(ctx, db, nil, func(tx *sql.Tx) error {
+		if _, err := tx.Exec(`
+			DELETE FROM email_changes WHERE user_id = $1
+			RETURNING NOTHING
+		`, authUserID); err != nil {
+			return err
+		}
+
+		_, err := tx.Exec(`
+			INSERT INTO email_changes (token_hash, cancel_token_hash, user_id, new_email, expires_at)
+			VALUES ($1, $2, $3, $4, $5)
+			RETURNING NOTHING
+		`, tokenHash, cancelTokenHash, authUserID, newEmail, time.Now().Add(emailChangeTokenLifespan))
+		return err
+	}); err != nil {
+		respondError(w, fmt.Errorf("could not insert email change: %v", err))
+		return
+	}
+
+	go sendEmailChangeLinks(oldEmail, newEmail, token, cancelToken)
+
+	recordSecurityEvent(r, authUserID, eventEmailChangeRequested, outcomeSuccess)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func sendEmailChangeLinks(oldEmail, newEmail, token, cancelToken string) {
+	link := origin + "/confirm_email_change?token=" + url.QueryEscape(token)
+	if err := mailer.Send(newEmail, "Confirm your new Nakama email", fmt.Sprintf(
+		"Click the link below to start using this email on Nakama.\n\n%s\n\nIt expires in %s.\n"+
+			"If you didn't ask for it, just ignore this email.\n",
+		link, emailChangeTokenLifespan)); err != nil {
+		log.Printf("could not send email change confirmation: %v\n", err)
+	}
+
+	cancelLink := origin + "/cancel_email_change?token=" + url.QueryEscape(cancelToken)
+	if err := mailer.Send(oldEmail, "Your Nakama email is changing", fmt.Sprintf(
+		"Someone asked to change the email of your Nakama account to %s.\n"+
+			"If it wasn't you, click the link below to cancel it and change your password.\n\n%s\n",
+		newEmail, cancelLink)); err != nil {
+		log.Printf("could not send email change notice: %v\n", err)
+	}
+}
+
+func confirmEmailChange(w http.ResponseWriter, r *http.Request) {
+	var input EmailChangeTokenInput
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer r.Body.Close()
+
+	ctx := r.Context()
+	var userID string
+	if err := crdb.ExecuteTx(ctx, db, nil, func(tx *sql.Tx) error {
+		var newEmail string
+		var expiresAt time.Time
+		if err := tx.QueryRow(`
+			DELETE FROM email_changes WHERE token_hash = $1
+			RETURNING user_id, new_email, expires_at
+		`, hashToken(input.Token)).Scan(&userID, &newEmail, &expiresAt); err != nil {
+			return err
+		}
+
+		if expiresAt.Before(time.Now()) {
+			return sql.ErrNoRows
+		}
+
+		if err := updateUserEmail(ctx, tx, userID, newEmail); err != nil {
+			return err
+		}
+
+		// Links sent to the old address stop working.
+		for _, query := range []string{
+			"DELETE FROM login_tokens WHERE user_id = $1 RETURNING NOTHING",
+			"DELETE FROM password_reset_tokens WHERE user_id = $1 RETURNING NOTHING",
+			"DELETE FROM email_verification_tokens WHERE user_id = $1 RETURNING NOTHING",
+		} {
+			if _, err := tx.Exec(query, userID); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}); err == sql.ErrNoRows {
+		http.Error(w, "Invalid or expired token", http.StatusUnauthorized)
+		return
+	} else if err == errEmailTaken {
+		respondJSON(w, map[string]string{
+			"email": "Email taken",
+		}, http.StatusUnprocessableEntity)
+		return
+	} else if err != nil {
+		respondError(w, fmt.Errorf("could not confirm email change: %v", err))
+		return
+	}
+
+	userCache.Invalidate(userID)
+	recordSecurityEvent(r, userID, eventEmailChanged, outcomeSuccess)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func cancelEmailChange(w http.ResponseWriter, r *http.Request) {
+	var input EmailChangeTokenInput
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer r.Body.Close()
+
+	var userID string
+	if err := db.QueryRowContext(r.Context(), `
+		DELETE FROM email_changes WHERE cancel_token_hash = $1
+		RETURNING user_id
+	`, hashToken(input.Token)).Scan(&userID); err == sql.ErrNoRows {
+		http.Error(w, "Invalid or already used token", http.StatusUnauthorized)
+		return
+	} else if err != nil {
+		respondError(w, fmt.Errorf("could not cancel email change: %v", err))
+		return
+	}
+
+	recordSecurityEvent(r, userID, eventEmailChangeCanceled, outcomeSuccess)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// updateUserEmail sets an already verified email.
+// The address could have been taken since the change was requested.
+func updateUserEmail(ctx context.Context, e execer, userID, email string) error {
+	_, err := e.ExecContext(ctx, `
+		UPDATE users SET email = $1, email_verified_at = now()
+		WHERE id = $2
+		RETURNING NOTHING
+	`, email, userID)
+	if errPq, ok := err.(*pq.Error); ok && errPq.Code.Name() == "unique_violation" {
+		return errEmailTaken
+	}
+	return err
+}
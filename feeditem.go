@@ -43,6 +43,9 @@ func getFeed(w http.ResponseWriter, r *http.Request) {
 			ON subscriptions.user_id = $1
 			AND subscriptions.post_id = posts.id
 		WHERE feed.user_id = $1
+			AND NOT `+sqlUserSuspended+`
+			AND `+sqlUserVisibleTo("$1")+`
+			AND NOT `+sqlMuted("$1", "posts.user_id", true)+`
 		ORDER BY posts.created_at DESC
 	`, authUserID)
 	if err != nil {
@@ -86,6 +89,8 @@ func getFeed(w http.ResponseWriter, r *http.Request) {
 	respondJSON(w, feed, http.StatusOK)
 }
 
+// feedFanout adds the post to the feed of the author followers.
+// Follows of private accounts are approved, so their posts reach nobody else.
 func feedFanout(post Post) {
 	post.Mine = false
 	post.Subscribed = false
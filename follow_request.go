@@ -0,0 +1,176 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+
+	"github.com/cockroachdb/cockroach-go/crdb"
+	"github.com/go-chi/chi"
+)
+
+// sqlUserVisibleTo is true for users whose posts can be seen
+// by the one at the given query parameter:
+// public ones, themselves and the private ones they follow,
+// as long as neither blocked the other.
+// An empty parameter stands for anonymous users, who only see public ones.
+func sqlUserVisibleTo(param string) string {
+	if param == "" {
+		return `NOT users.private`
+	}
+	return `((NOT users.private OR users.id = ` + param + ` OR EXISTS (
+		SELECT 1 FROM follows WHERE follower_id = ` + param + ` AND following_id = users.id
+	)) AND ` + sqlNotBlocked(param, "users.id") + `)`
+}
+
+// TODO: add pagination
+func getFollowRequests(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	authUserID := ctx.Value(keyAuthUserID).(string)
+
+	rows, err := db.QueryContext(ctx, `
+		SELECT
+			users.username,
+			users.avatar_url,
+			users.display_name,
+			users.bio,
+			users.private,
+			users.followers_count,
+			users.following_count,
+			users.created_at,
+			followers.follower_id IS NOT NULL AS following_of_mine
+		FROM follow_requests
+		INNER JOIN users ON follow_requests.follower_id = users.id
+		LEFT JOIN follows AS followers
+			ON followers.follower_id = $1
+			AND followers.following_id = users.id
+		WHERE follow_requests.following_id = $1
+		ORDER BY follow_requests.created_at DESC
+	`, authUserID)
+	if err != nil {
+		respondError(w, fmt.Errorf("could not query follow requests: %v", err))
+		return
+	}
+	defer rows.Close()
+
+	users := make([]Profile, 0)
+	for rows.Next() {
+		var user Profile
+		if err = rows.Scan(
+			&user.Username,
+			&user.AvatarURL,
+			&user.DisplayName,
+			&user.Bio,
+			&user.Private,
+			&user.FollowersCount,
+			&user.FollowingCount,
+			&user.CreatedAt,
+			&user.FollowingOfMine,
+		); err != nil {
+			respondError(w, fmt.Errorf("could not scan follow request: %v", err))
+			return
+		}
+
+		users = append(users, user)
+	}
+	if err = rows.Err(); err != nil {
+		respondError(w, fmt.Errorf("could not iterate over follow requests: %v", err))
+		return
+	}
+
+	respondJSON(w, users, http.StatusOK)
+}
+
+func approveFollowRequest(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	authUser := ctx.Value(keyAuthUser).(User)
+	username := chi.URLParam(r, "username")
+
+	var followerID string
+	if err := crdb.ExecuteTx(ctx, db, nil, func(tx *sql.Tx) error {
+		if err := tx.QueryRow(`
+			DELETE FROM follow_requests
+			WHERE follower_id = (SELECT id FROM users WHERE username = $1)
+				AND following_id = $2
+			RETURNING follower_id
+		`, username, authUser.ID).Scan(&followerID); err != nil {
+			return err
+		}
+
+		_, err := insertFollow(tx, followerID, authUser.ID)
+		return err
+	}); err == sql.ErrNoRows {
+		http.Error(w, "Follow request not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		respondError(w, fmt.Errorf("could not approve follow request: %v", err))
+		return
+	}
+
+	recordSecurityEvent(r, authUser.ID, eventFollowRequestApproved, outcomeSuccess)
+	go createFollowNotification(authUser, followerID, "follow_request_approved")
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// approveAllFollowRequests turns the pending follow requests to the user into follows
+// and returns the ids of the followers.
+func approveAllFollowRequests(tx *sql.Tx, userID string) ([]string, error) {
+	rows, err := tx.Query(`
+		DELETE FROM follow_requests
+		WHERE following_id = $1
+		RETURNING follower_id
+	`, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	var followerIDs []string
+	for rows.Next() {
+		var followerID string
+		if err = rows.Scan(&followerID); err != nil {
+			rows.Close()
+			return nil, err
+		}
+
+		followerIDs = append(followerIDs, followerID)
+	}
+	if err = rows.Close(); err != nil {
+		return nil, err
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for _, followerID := range followerIDs {
+		if _, err = insertFollow(tx, followerID, userID); err != nil {
+			return nil, err
+		}
+	}
+
+	return followerIDs, nil
+}
+
+func rejectFollowRequest(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	authUserID := ctx.Value(keyAuthUserID).(string)
+	username := chi.URLParam(r, "username")
+
+	var followerID string
+	if err := db.QueryRowContext(ctx, `
+		DELETE FROM follow_requests
+		WHERE follower_id = (SELECT id FROM users WHERE username = $1)
+			AND following_id = $2
+		RETURNING follower_id
+	`, username, authUserID).Scan(&followerID); err == sql.ErrNoRows {
+		http.Error(w, "Follow request not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		respondError(w, fmt.Errorf("could not reject follow request: %v", err))
+		return
+	}
+
+	recordSecurityEvent(r, authUserID, eventFollowRequestRejected, outcomeSuccess)
+
+	w.WriteHeader(http.StatusNoContent)
+}
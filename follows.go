@@ -0,0 +1,206 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi"
+)
+
+// FollowsPage response body
+type FollowsPage struct {
+	Users      []Profile `json:"users"`
+	NextCursor *string   `json:"nextCursor"`
+}
+
+const followsPageSize = 20
+
+var errInvalidCursor = errors.New("invalid cursor")
+
+func getFollowers(w http.ResponseWriter, r *http.Request) {
+	getFollows(w, r, true)
+}
+
+func getFollowees(w http.ResponseWriter, r *http.Request) {
+	getFollows(w, r, false)
+}
+
+// getFollows lists the followers or followees of a user,
+// most recent follows first.
+func getFollows(w http.ResponseWriter, r *http.Request, followers bool) {
+	ctx := r.Context()
+	authUserID, authenticated := ctx.Value(keyAuthUserID).(string)
+	username := chi.URLParam(r, "username")
+
+	lookupQuery := "SELECT id, " + sqlUserVisibleTo("") + " FROM users WHERE username = $1"
+	lookupArgs := []interface{}{username}
+	if authenticated {
+		lookupQuery = "SELECT id, " + sqlUserVisibleTo("$2") + " FROM users WHERE username = $1"
+		lookupArgs = append(lookupArgs, authUserID)
+	}
+
+	var userID string
+	var visible bool
+	if err := db.QueryRowContext(ctx, lookupQuery, lookupArgs...).
+		Scan(&userID, &visible); err == sql.ErrNoRows {
+		http.Error(w,
+			http.StatusText(http.StatusNotFound),
+			http.StatusNotFound)
+		return
+	} else if err != nil {
+		respondError(w, fmt.Errorf("could not query user: %v", err))
+		return
+	}
+
+	// Like their posts, who private accounts follow is for followers only.
+	if !visible {
+		http.Error(w, "Private account", http.StatusForbidden)
+		return
+	}
+
+	// The listed users are on one side of the follow; the given one on the other.
+	listed, other := "follower_id", "following_id"
+	if !followers {
+		listed, other = other, listed
+	}
+
+	query := `
+		SELECT
+			users.id,
+			users.username,
+			users.avatar_url,
+			users.display_name,
+			users.bio,
+			users.private,
+			users.followers_count,
+			users.following_count,
+			users.created_at,
+			follows.created_at`
+	args := []interface{}{userID}
+	if authenticated {
+		args = append(args, authUserID)
+		query += `,
+			following.following_id IS NOT NULL AS follower_of_mine,
+			followers.follower_id IS NOT NULL AS following_of_mine`
+	}
+	query += `
+		FROM follows
+		INNER JOIN users ON follows.` + listed + ` = users.id`
+	if authenticated {
+		query += `
+		LEFT JOIN follows AS followers
+			ON followers.follower_id = $2
+			AND followers.following_id = users.id
+		LEFT JOIN follows AS following
+			ON following.follower_id = users.id
+			AND following.following_id = $2`
+	}
+	query += `
+		WHERE follows.` + other + ` = $1`
+	if s := r.URL.Query().Get("after"); s != "" {
+		followedAt, id, err := decodeFollowsCursor(s)
+		if err != nil {
+			http.Error(w, "Invalid cursor", http.StatusBadRequest)
+			return
+		}
+		args = append(args, followedAt, id)
+		query += fmt.Sprintf(`
+			AND (follows.created_at, users.id) < ($%d, $%d)`, len(args)-1, len(args))
+	}
+	// One more than a page, to know if there is a next one.
+	query += fmt.Sprintf(`
+		ORDER BY follows.created_at DESC, users.id DESC
+		LIMIT %d`, followsPageSize+1)
+
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		respondError(w, fmt.Errorf("could not query follows: %v", err))
+		return
+	}
+	defer rows.Close()
+
+	page := FollowsPage{Users: make([]Profile, 0)}
+	var lastFollowedAt time.Time
+	var lastID string
+	for rows.Next() {
+		var id string
+		var followedAt time.Time
+		var user Profile
+		dest := []interface{}{
+			&id,
+			&user.Username,
+			&user.AvatarURL,
+			&user.DisplayName,
+			&user.Bio,
+			&user.Private,
+			&user.FollowersCount,
+			&user.FollowingCount,
+			&user.CreatedAt,
+			&followedAt,
+		}
+		if authenticated {
+			dest = append(dest,
+				&user.FollowerOfMine,
+				&user.FollowingOfMine,
+			)
+		}
+
+		if err = rows.Scan(dest...); err != nil {
+			respondError(w, fmt.Errorf("could not scan follow: %v", err))
+			return
+		}
+
+		if len(page.Users) == followsPageSize {
+			cursor := encodeFollowsCursor(lastFollowedAt, lastID)
+			page.NextCursor = &cursor
+			break
+		}
+
+		user.Me = authenticated && id == authUserID
+		page.Users = append(page.Users, user)
+		lastFollowedAt, lastID = followedAt, id
+	}
+	if err = rows.Err(); err != nil {
+		respondError(w, fmt.Errorf("could not iterate over follows: %v", err))
+		return
+	}
+
+	respondJSON(w, page, http.StatusOK)
+}
+
+// encodeFollowsCursor points right after the given follow.
+// Clients must not rely on its format.
+func encodeFollowsCursor(followedAt time.Time, userID string) string {
+	return base64.RawURLEncoding.EncodeToString(
+		[]byte(strconv.FormatInt(followedAt.UnixNano(), 10) + ":" + userID))
+}
+
+func decodeFollowsCursor(cursor string) (time.Time, int64, error) {
+	b, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return time.Time{}, 0, errInvalidCursor
+	}
+
+	parts := strings.SplitN(string(b), ":", 2)
+	if len(parts) != 2 {
+		return time.Time{}, 0, errInvalidCursor
+	}
+
+	nsec, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return time.Time{}, 0, errInvalidCursor
+	}
+
+	id, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return time.Time{}, 0, errInvalidCursor
+	}
+
+	return time.Unix(0, nsec), id, nil
+}
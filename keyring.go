@@ -0,0 +1,239 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"strings"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+// KeyRing holds the keys that verify JWTs, selected by the kid header,
+// and the one that signs new ones.
+// Rotation goes by adding a new key, making it current once deployed,
+// and removing the old one after every token it signed expired.
+// Public keys are published as JWKS so other services can verify tokens too.
+type KeyRing struct {
+	currentID string
+	keys      map[string]signingKey
+}
+
+type signingKey struct {
+	method    jwt.SigningMethod
+	signKey   interface{} // nil for verification only keys.
+	verifyKey interface{}
+}
+
+// JWK is a JSON web key. Only public keys are represented.
+type JWK struct {
+	KeyType   string `json:"kty"`
+	KeyID     string `json:"kid"`
+	Use       string `json:"use"`
+	Algorithm string `json:"alg"`
+	Curve     string `json:"crv,omitempty"`
+	N         string `json:"n,omitempty"`
+	E         string `json:"e,omitempty"`
+	X         string `json:"x,omitempty"`
+}
+
+// JWKS is a JSON web key set.
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+// defaultKeyID is assumed for tokens without kid header
+// and for the key given through JWT_KEY.
+const defaultKeyID = "default"
+
+var keyRing *KeyRing
+
+var errUnknownKey = errors.New("unknown signing key")
+
+// ParseKeyRing from a comma separated list of id:key pairs.
+// A key is either an HMAC secret or a PEM file prefixed with its method,
+// like RS256:/path/to/key.pem or EdDSA:/path/to/key.pem.
+// The PEM can hold a public key only, to keep verifying tokens of a retired key.
+// currentID selects the signing key; it defaults to the first one.
+func ParseKeyRing(s, currentID string) (*KeyRing, error) {
+	kr := &KeyRing{keys: map[string]signingKey{}}
+	for i, pair := range strings.Split(s, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+
+		parts := strings.SplitN(pair, ":", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("invalid key #%d: expected id:key", i+1)
+		}
+
+		id := parts[0]
+		if _, ok := kr.keys[id]; ok {
+			return nil, fmt.Errorf("duplicated key id %q", id)
+		}
+
+		key, err := parseSigningKey(parts[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid key %q: %v", id, err)
+		}
+
+		kr.keys[id] = key
+		if currentID == "" && key.signKey != nil {
+			currentID = id
+		}
+	}
+
+	if len(kr.keys) == 0 {
+		return nil, errors.New("no keys")
+	}
+
+	if key, ok := kr.keys[currentID]; !ok {
+		return nil, fmt.Errorf("current key %q not found", currentID)
+	} else if key.signKey == nil {
+		return nil, fmt.Errorf("current key %q can't sign", currentID)
+	}
+
+	kr.currentID = currentID
+	return kr, nil
+}
+
+func parseSigningKey(s string) (signingKey, error) {
+	var method jwt.SigningMethod
+	if strings.HasPrefix(s, "RS256:") {
+		method = jwt.SigningMethodRS256
+	} else if strings.HasPrefix(s, "EdDSA:") {
+		method = signingMethodEdDSA
+	} else {
+		secret := []byte(strings.TrimPrefix(s, "HS256:"))
+		return signingKey{jwt.SigningMethodHS256, secret, secret}, nil
+	}
+
+	b, err := ioutil.ReadFile(s[len(method.Alg())+1:])
+	if err != nil {
+		return signingKey{}, err
+	}
+
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return signingKey{}, errors.New("no PEM data")
+	}
+
+	var parsed interface{}
+	switch block.Type {
+	case "PUBLIC KEY":
+		parsed, err = x509.ParsePKIXPublicKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		parsed, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		parsed, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	default:
+		err = fmt.Errorf("unsupported PEM type %q", block.Type)
+	}
+	if err != nil {
+		return signingKey{}, err
+	}
+
+	switch k := parsed.(type) {
+	case *rsa.PrivateKey:
+		if method == jwt.SigningMethodRS256 {
+			return signingKey{method, k, &k.PublicKey}, nil
+		}
+	case *rsa.PublicKey:
+		if method == jwt.SigningMethodRS256 {
+			return signingKey{method, nil, k}, nil
+		}
+	case ed25519.PrivateKey:
+		if method == signingMethodEdDSA {
+			return signingKey{method, k, k.Public()}, nil
+		}
+	case ed25519.PublicKey:
+		if method == signingMethodEdDSA {
+			return signingKey{method, nil, k}, nil
+		}
+	}
+
+	return signingKey{}, fmt.Errorf("key type doesn't match %s", method.Alg())
+}
+
+// Sign claims with the current key.
+func (kr *KeyRing) Sign(claims jwt.Claims) (string, error) {
+	key := kr.keys[kr.currentID]
+	token := jwt.NewWithClaims(key.method, claims)
+	token.Header["kid"] = kr.currentID
+	return token.SignedString(key.signKey)
+}
+
+// Keyfunc selects the verification key by the kid header.
+func (kr *KeyRing) Keyfunc(token *jwt.Token) (interface{}, error) {
+	kid, ok := token.Header["kid"].(string)
+	if !ok {
+		kid = defaultKeyID
+	}
+
+	key, ok := kr.keys[kid]
+	if !ok {
+		return nil, errUnknownKey
+	}
+
+	// A key is only good for the method it was made for.
+	if token.Method.Alg() != key.method.Alg() {
+		return nil, errUnknownKey
+	}
+
+	return key.verifyKey, nil
+}
+
+// JWKS with the public keys of the ring.
+// HMAC secrets are never published.
+func (kr *KeyRing) JWKS() JWKS {
+	jwks := JWKS{Keys: make([]JWK, 0, len(kr.keys))}
+	for id, key := range kr.keys {
+		switch k := key.verifyKey.(type) {
+		case *rsa.PublicKey:
+			jwks.Keys = append(jwks.Keys, JWK{
+				KeyType:   "RSA",
+				KeyID:     id,
+				Use:       "sig",
+				Algorithm: key.method.Alg(),
+				N:         base64.RawURLEncoding.EncodeToString(k.N.Bytes()),
+				E:         base64.RawURLEncoding.EncodeToString(big.NewInt(int64(k.E)).Bytes()),
+			})
+		case ed25519.PublicKey:
+			jwks.Keys = append(jwks.Keys, JWK{
+				KeyType:   "OKP",
+				KeyID:     id,
+				Use:       "sig",
+				Algorithm: key.method.Alg(),
+				Curve:     "Ed25519",
+				X:         base64.RawURLEncoding.EncodeToString(k),
+			})
+		}
+	}
+	return jwks
+}
+
+// ValidMethods lists the signing methods of all the keys.
+func (kr *KeyRing) ValidMethods() []string {
+	var methods []string
+	seen := map[string]bool{}
+	for _, key := range kr.keys {
+		if alg := key.method.Alg(); !seen[alg] {
+			seen[alg] = true
+			methods = append(methods, alg)
+		}
+	}
+	return methods
+}
+
+func getJWKS(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	respondJSON(w, keyRing.JWKS(), http.StatusOK)
+}
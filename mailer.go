@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/smtp"
+	"strings"
+)
+
+// Mailer sends emails.
+type Mailer interface {
+	Send(to, subject, body string) error
+}
+
+// SMTPMailer sends emails through an SMTP server.
+type SMTPMailer struct {
+	Addr string
+	From string
+	Auth smtp.Auth
+}
+
+// LogMailer writes emails to a logger instead of sending them.
+// Useful for development and testing.
+type LogMailer struct {
+	Logger *log.Logger
+}
+
+var mailer Mailer
+
+// NewSMTPMailer with plain auth if username is not empty.
+func NewSMTPMailer(addr, from, username, password string) *SMTPMailer {
+	m := &SMTPMailer{Addr: addr, From: from}
+	if username != "" {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			host = addr
+		}
+		m.Auth = smtp.PlainAuth("", username, password, host)
+	}
+	return m
+}
+
+// Send an email.
+func (m *SMTPMailer) Send(to, subject, body string) error {
+	msg := strings.Join([]string{
+		"From: " + m.From,
+		"To: " + to,
+		"Subject: " + subject,
+		"MIME-Version: 1.0",
+		"Content-Type: text/plain; charset=utf-8",
+		"",
+		body,
+	}, "\r\n")
+	if err := smtp.SendMail(m.Addr, m.Auth, m.From, []string{to}, []byte(msg)); err != nil {
+		return fmt.Errorf("could not send mail: %v", err)
+	}
+	return nil
+}
+
+// Send an email. Just prints it.
+func (m *LogMailer) Send(to, subject, body string) error {
+	m.Logger.Printf("to: %s\nsubject: %s\n\n%s\n", to, subject, body)
+	return nil
+}
@@ -4,10 +4,12 @@ import (
 	"context"
 	"database/sql"
 	"encoding/json"
+	"expvar"
 	"log"
 	"net/http"
 	"os"
 	"os/signal"
+	"strings"
 	"time"
 
 	"github.com/go-chi/chi"
@@ -16,6 +18,7 @@ import (
 )
 
 var db *sql.DB
+var origin = env("ORIGIN", "http://localhost")
 
 func main() {
 	var err error
@@ -29,28 +32,144 @@ func main() {
 		log.Fatalf("could not ping to database: %v\n", err)
 	}
 
+	if keys, ok := os.LookupEnv("JWT_KEYS"); ok {
+		keyRing, err = ParseKeyRing(keys, env("JWT_KEY_ID", ""))
+	} else if key, ok := os.LookupEnv("JWT_KEY"); ok {
+		keyRing, err = ParseKeyRing(defaultKeyID+":"+key, "")
+	} else {
+		// A guessable default would let anyone forge tokens.
+		var key string
+		if key, err = randomString(); err != nil {
+			log.Fatalf("could not generate JWT key: %v\n", err)
+		}
+		log.Println("WARNING: neither JWT_KEYS nor JWT_KEY set; using a random key, so access tokens won't survive restarts nor work across instances")
+		keyRing, err = ParseKeyRing(defaultKeyID+":"+key, "")
+	}
+	if err != nil {
+		log.Fatalf("could not load JWT keys: %v\n", err)
+	}
+
+	for _, name := range strings.Split(env("OIDC_PROVIDERS", ""), ",") {
+		if name = strings.TrimSpace(name); name == "" {
+			continue
+		}
+		prefix := "OIDC_" + strings.ToUpper(name) + "_"
+		oidcProviders[name] = &OIDCProvider{
+			Name:         name,
+			Issuer:       env(prefix+"ISSUER", ""),
+			ClientID:     env(prefix+"CLIENT_ID", ""),
+			ClientSecret: env(prefix+"CLIENT_SECRET", ""),
+		}
+	}
+
+	if smtpAddr, ok := os.LookupEnv("SMTP_ADDR"); ok {
+		mailer = NewSMTPMailer(smtpAddr,
+			env("SMTP_FROM", "noreply@localhost"),
+			env("SMTP_USERNAME", ""),
+			env("SMTP_PASSWORD", ""))
+	} else if mailLog, ok := os.LookupEnv("MAIL_LOG_FILE"); ok {
+		f, err := os.OpenFile(mailLog, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+		if err != nil {
+			log.Fatalf("could not open mail log file: %v\n", err)
+		}
+		defer f.Close()
+		mailer = &LogMailer{Logger: log.New(f, "", log.LstdFlags)}
+	} else {
+		// Emails carry login and reset links; they shouldn't end up in shared logs unnoticed.
+		log.Println("WARNING: neither SMTP_ADDR nor MAIL_LOG_FILE set; emails, with their login links, are printed to stdout")
+		mailer = &LogMailer{Logger: log.New(os.Stdout, "mail: ", log.LstdFlags)}
+	}
+
+	if gracePeriod, ok := os.LookupEnv("ACCOUNT_DELETION_GRACE_PERIOD"); ok {
+		if accountDeletionGracePeriod, err = time.ParseDuration(gracePeriod); err != nil {
+			log.Fatalf("could not parse account deletion grace period: %v\n", err)
+		}
+	}
+	go purgeDeletedUsers()
+
+	if ttl, ok := os.LookupEnv("USER_CACHE_TTL"); ok {
+		if userCache.TTL, err = time.ParseDuration(ttl); err != nil {
+			log.Fatalf("could not parse user cache TTL: %v\n", err)
+		}
+	}
+
+	avatars := &FileStorage{
+		Dir:     env("AVATARS_DIR", "avatars"),
+		BaseURL: origin + "/avatars/",
+	}
+	storage = avatars
+
 	mux := chi.NewMux()
 	mux.Use(middleware.Recoverer)
+	// Only behind a trusted proxy; otherwise anyone could spoof their IP.
+	if env("TRUST_PROXY_HEADERS", "") == "true" {
+		mux.Use(middleware.RealIP)
+	}
 	mux.Route("/api", func(api chi.Router) {
 		jsonRequired := middleware.AllowContentType("application/json")
 		api.With(jsonRequired).Post("/login", login)
-		api.Post("/logout", logout)
+		api.Get("/login/callback", loginCallback)
+		api.With(jsonRequired).Post("/login/totp", loginTOTP)
+		api.Get("/oidc_providers", getOIDCProviders)
+		api.Get("/oidc/{provider}/login", oidcLogin)
+		api.Get("/oidc/{provider}/callback", oidcCallback)
+		api.With(jsonRequired).Post("/request_password_reset", requestPasswordReset)
+		api.With(jsonRequired).Post("/reset_password", resetPassword)
+		api.With(csrfProtect("refresh_token")).Post("/logout", logout)
+		api.With(csrfProtect("refresh_token")).Post("/token/refresh", refreshToken)
 		api.With(jsonRequired).Post("/users", createUser)
+		api.With(jsonRequired).Post("/verify_email", verifyEmail)
+		api.With(allowUnverified, mustAuthUser, requireSession).Post("/auth_user/resend_verification_email", resendVerificationEmail)
+		api.With(jsonRequired, allowUnverified, mustAuthUser, requireSession).Post("/auth_user/email", changeEmail)
+		api.With(jsonRequired, allowUnverified, mustAuthUser, requireSession).Delete("/auth_user", deleteAccount)
+		api.With(jsonRequired, mustAuthUser, requireSession).Patch("/auth_user", updateProfile)
+		api.With(mustAuthUser, requireSession).Put("/auth_user/avatar", updateAvatar)
+		api.With(jsonRequired).Post("/confirm_email_change", confirmEmailChange)
+		api.With(jsonRequired).Post("/cancel_email_change", cancelEmailChange)
+		api.With(jsonRequired, allowUnverified, mustAuthUser, requireSession).Post("/auth_user/password", changePassword)
+		api.With(allowUnverified, mustAuthUser, requireSession).Post("/auth_user/totp", enrollTOTP)
+		api.With(jsonRequired, allowUnverified, mustAuthUser, requireSession).Post("/auth_user/totp/confirm", confirmTOTP)
+		api.With(jsonRequired, allowUnverified, mustAuthUser, requireSession).Post("/auth_user/totp/disable", disableTOTP)
+		api.With(mustAuthUser, requireSession).Get("/auth_user/tokens", getPersonalTokens)
+		api.With(jsonRequired, allowUnverified, mustAuthUser, requireSession).Post("/auth_user/tokens", createPersonalToken)
+		api.With(allowUnverified, mustAuthUser, requireSession).Delete("/auth_user/tokens/{token_id}", deletePersonalToken)
+		api.With(mustAuthUser, requireSession).Get("/auth_user/security_events", getSecurityEvents)
+		api.With(mustAuthUser, requireSession).Get("/sessions", getSessions)
+		api.With(allowUnverified, mustAuthUser, requireSession).Delete("/sessions", deleteSessions)
+		api.With(allowUnverified, mustAuthUser, requireSession).Delete("/sessions/{session_id}", deleteSession)
 		api.With(maybeAuthUserID).Get("/users", getUsers)
 		api.With(maybeAuthUserID).Get("/users/{username}", getUser)
-		api.With(mustAuthUser).Post("/users/{username}/toggle_follow", toggleFollow)
-		api.With(jsonRequired, mustAuthUser).Post("/posts", createPost)
+		api.With(mustAuthUser, requireScope(scopeFollowsWrite)).Post("/users/{username}/toggle_follow", toggleFollow)
+		api.With(mustAuthUser, requireSession).Post("/users/{username}/block", blockUser)
+		api.With(mustAuthUser, requireSession).Post("/users/{username}/unblock", unblockUser)
+		api.With(jsonRequired, mustAuthUser, requireSession).Post("/users/{username}/mute", muteUser)
+		api.With(mustAuthUser, requireSession).Post("/users/{username}/unmute", unmuteUser)
+		api.With(maybeAuthUserID).Get("/users/{username}/followers", getFollowers)
+		api.With(maybeAuthUserID).Get("/users/{username}/followees", getFollowees)
+		api.With(mustAuthUser, requireSession).Get("/suggested_users", getSuggestedUsers)
+		api.With(mustAuthUser, requireSession).Get("/auth_user/follow_requests", getFollowRequests)
+		api.With(mustAuthUser, requireSession).Post("/auth_user/follow_requests/{username}/approve", approveFollowRequest)
+		api.With(mustAuthUser, requireSession).Post("/auth_user/follow_requests/{username}/reject", rejectFollowRequest)
+		api.With(jsonRequired, mustAuthUser, requireSession, requireRole(roleAdmin)).Put("/users/{username}/role", setUserRole)
+		api.With(mustAuthUser, requireSession, requireRole(roleAdmin)).Get("/debug/vars", expvar.Handler().ServeHTTP)
+		api.With(jsonRequired, mustAuthUser, requireSession, requireRole(roleModerator)).Post("/users/{username}/suspend", suspendUser)
+		api.With(mustAuthUser, requireSession, requireRole(roleModerator)).Post("/users/{username}/unsuspend", unsuspendUser)
+		api.With(jsonRequired, mustAuthUser, requireSession, requireRole(roleAdmin)).Post("/users/{username}/ban", banUser)
+		api.With(mustAuthUser, requireSession, requireRole(roleAdmin)).Post("/users/{username}/unban", unbanUser)
+		api.With(jsonRequired, mustAuthUser, requireScope(scopePostsWrite)).Post("/posts", createPost)
 		api.With(maybeAuthUserID).Get("/users/{username}/posts", getPosts)
 		api.With(maybeAuthUserID).Get("/posts/{post_id}", getPost)
-		api.With(mustAuthUser).Get("/feed", getFeed)
-		api.With(jsonRequired, mustAuthUser).Post("/posts/{post_id}/comments", createComment)
+		api.With(mustAuthUser, requireScope(scopeFeedRead)).Get("/feed", getFeed)
+		api.With(jsonRequired, mustAuthUser, requireScope(scopeCommentsWrite)).Post("/posts/{post_id}/comments", createComment)
 		api.With(maybeAuthUserID).Get("/posts/{post_id}/comments", getComments)
-		api.With(mustAuthUser).Post("/posts/{post_id}/toggle_like", togglePostLike)
-		api.With(mustAuthUser).Post("/posts/{post_id}/toggle_subscription", toggleSubscription)
-		api.With(mustAuthUser).Post("/comments/{comment_id}/toggle_like", toggleCommentLike)
-		api.With(mustAuthUser).Get("/notifications", getNotifications)
-		api.With(mustAuthUser).Get("/check_unread_notifications", checkUnreadNotifications)
+		api.With(mustAuthUser, requireScope(scopePostsWrite)).Post("/posts/{post_id}/toggle_like", togglePostLike)
+		api.With(mustAuthUser, requireScope(scopePostsWrite)).Post("/posts/{post_id}/toggle_subscription", toggleSubscription)
+		api.With(mustAuthUser, requireScope(scopeCommentsWrite)).Post("/comments/{comment_id}/toggle_like", toggleCommentLike)
+		api.With(mustAuthUser, requireScope(scopeNotificationsRead)).Get("/notifications", getNotifications)
+		api.With(mustAuthUser, requireScope(scopeNotificationsRead)).Get("/check_unread_notifications", checkUnreadNotifications)
 	})
+	mux.Get("/.well-known/jwks.json", getJWKS)
+	mux.Get("/avatars/*", avatars.ServeHTTP)
 	mux.Group(func(mux chi.Router) {
 		// TODO: remove no cache
 		mux.Use(middleware.NoCache)
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi"
+)
+
+// MuteUserInput request body
+type MuteUserInput struct {
+	Until             *time.Time `json:"until,omitempty"`
+	NotificationsOnly bool       `json:"notificationsOnly"`
+}
+
+// sqlMuted is true when the muter currently mutes the muted user.
+// Mutes of notifications only don't count for the feed.
+func sqlMuted(muter, muted string, feed bool) string {
+	query := `EXISTS (
+		SELECT 1 FROM mutes
+		WHERE muter_id = ` + muter + `
+			AND muted_id = ` + muted + `
+			AND (expires_at IS NULL OR expires_at > now())`
+	if feed {
+		query += `
+			AND NOT notifications_only`
+	}
+	return query + `
+	)`
+}
+
+// muteUser hides the user's posts from the feed and their activity
+// from notifications, without unfollowing.
+// Muting again replaces the previous mute.
+func muteUser(w http.ResponseWriter, r *http.Request) {
+	var input MuteUserInput
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer r.Body.Close()
+
+	if input.Until != nil && input.Until.Before(time.Now()) {
+		respondJSON(w, map[string]string{
+			"until": "Mute must end in the future",
+		}, http.StatusUnprocessableEntity)
+		return
+	}
+
+	ctx := r.Context()
+	authUserID := ctx.Value(keyAuthUserID).(string)
+	username := chi.URLParam(r, "username")
+
+	var userID string
+	if err := db.QueryRowContext(ctx, "SELECT id FROM users WHERE username = $1", username).
+		Scan(&userID); err == sql.ErrNoRows {
+		http.Error(w,
+			http.StatusText(http.StatusNotFound),
+			http.StatusNotFound)
+		return
+	} else if err != nil {
+		respondError(w, fmt.Errorf("could not query user to mute: %v", err))
+		return
+	}
+
+	if userID == authUserID {
+		http.Error(w, "Try muting someone else", http.StatusForbidden)
+		return
+	}
+
+	if _, err := db.ExecContext(ctx, `
+		UPSERT INTO mutes (muter_id, muted_id, notifications_only, expires_at)
+		VALUES ($1, $2, $3, $4)
+		RETURNING NOTHING
+	`, authUserID, userID, input.NotificationsOnly, input.Until); err != nil {
+		respondError(w, fmt.Errorf("could not mute user: %v", err))
+		return
+	}
+
+	recordSecurityEvent(r, authUserID, eventMute, outcomeSuccess)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func unmuteUser(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	authUserID := ctx.Value(keyAuthUserID).(string)
+	username := chi.URLParam(r, "username")
+
+	if _, err := db.ExecContext(ctx, `
+		DELETE FROM mutes
+		WHERE muter_id = $1
+			AND muted_id = (SELECT id FROM users WHERE username = $2)
+		RETURNING NOTHING
+	`, authUserID, username); err != nil {
+		respondError(w, fmt.Errorf("could not unmute user: %v", err))
+		return
+	}
+
+	recordSecurityEvent(r, authUserID, eventUnmute, outcomeSuccess)
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -44,6 +44,7 @@ func getNotifications(w http.ResponseWriter, r *http.Request) {
 		INNER JOIN users AS actors ON notifications.actor_id = actors.id
 		INNER JOIN users ON notifications.user_id = users.id
 		WHERE notifications.user_id = $1
+			AND NOT `+sqlMuted("$1", "notifications.actor_id", false)+`
 		ORDER BY notifications.issued_at DESC
 	`, authUserID)
 	if err != nil {
@@ -101,6 +102,7 @@ func checkUnreadNotifications(w http.ResponseWriter, r *http.Request) {
 		FROM notifications
 		INNER JOIN users ON notifications.user_id = users.id
 		WHERE notifications.user_id = $1
+			AND NOT `+sqlMuted("$1", "notifications.actor_id", false)+`
 		ORDER BY notifications.issued_at DESC
 		LIMIT 1
 	`, authUserID).Scan(&unread); err != nil && err != sql.ErrNoRows {
@@ -111,7 +113,9 @@ func checkUnreadNotifications(w http.ResponseWriter, r *http.Request) {
 	respondJSON(w, unread, http.StatusOK)
 }
 
-func createFollowNotification(follower User, followingID string) {
+// createFollowNotification notifies userID about actor once per verb:
+// "follow", "follow_request" or "follow_request_approved".
+func createFollowNotification(actor User, userID, verb string) {
 	var exists bool
 	var notification Notification
 	if err := crdb.ExecuteTx(context.Background(), db, nil, func(tx *sql.Tx) error {
@@ -119,8 +123,8 @@ func createFollowNotification(follower User, followingID string) {
 			SELECT 1 FROM notifications
 			WHERE user_id = $1
 				AND actor_id = $2
-				AND verb = 'follow'
-		)`, followingID, follower.ID).Scan(&exists); err != nil {
+				AND verb = $3
+		)`, userID, actor.ID, verb).Scan(&exists); err != nil {
 			return err
 		}
 
@@ -129,23 +133,23 @@ func createFollowNotification(follower User, followingID string) {
 		}
 
 		return tx.QueryRow(`
-			INSERT INTO notifications (user_id, actor_id, verb) VALUES ($1, $2, 'follow')
+			INSERT INTO notifications (user_id, actor_id, verb) VALUES ($1, $2, $3)
 			RETURNING id, issued_at
-		`, followingID, follower.ID).Scan(&notification.ID, &notification.IssuedAt)
+		`, userID, actor.ID, verb).Scan(&notification.ID, &notification.IssuedAt)
 	}); err != nil {
-		log.Printf("could not create follow notification: %v\n", err)
+		log.Printf("could not create %s notification: %v\n", verb, err)
 		return
 	}
 
-	notification.UserID = followingID
-	notification.ActorID = follower.ID
-	notification.Verb = "follow"
-	notification.ActorUsername = follower.Username
+	notification.UserID = userID
+	notification.ActorID = actor.ID
+	notification.Verb = verb
+	notification.ActorUsername = actor.Username
 	created := !exists
 
 	if created {
 		// TODO: broadcast notification
-		log.Printf("follow notification created: %v\n", notification)
+		log.Printf("%s notification created: %v\n", verb, notification)
 	}
 }
 
@@ -155,6 +159,7 @@ func commentNotificationFanout(comment Comment) {
 		SELECT user_id, $1, 'comment', $2, $3
 		FROM subscriptions
 		WHERE user_id != $1 AND post_id = $3
+			AND `+sqlNotBlocked("$1", "subscriptions.user_id")+`
 		RETURNING id, user_id, issued_at
 	`, comment.UserID, comment.ID, comment.PostID)
 	if err != nil {
@@ -201,6 +206,7 @@ func postMentionNotificationFanout(post Post) {
 		FROM users
 		WHERE id != $1
 			AND username = ANY($3)
+			AND `+sqlNotBlocked("$1", "users.id")+`
 		RETURNING id, user_id, issued_at
 	`, post.UserID, post.ID, pq.Array(usernames))
 	if err != nil {
@@ -242,6 +248,7 @@ func commentMentionNotificationFanout(comment Comment) {
 		FROM users
 		WHERE id != $1
 			AND username = ANY($4)
+			AND `+sqlNotBlocked("$1", "users.id")+`
 		RETURNING id, user_id, issued_at
 	`, comment.UserID, comment.ID, comment.PostID, pq.Array(usernames))
 	if err != nil {
@@ -0,0 +1,479 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/go-chi/chi"
+)
+
+// OIDCProvider is an OpenID Connect identity provider
+// users can sign in with through the authorization code flow with PKCE.
+type OIDCProvider struct {
+	Name         string
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+
+	mu     sync.Mutex
+	config *oidcConfig
+	keys   map[string]interface{}
+}
+
+type oidcConfig struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+type oidcTokenResponse struct {
+	IDToken string `json:"id_token"`
+}
+
+type oidcAudience []string
+
+type idTokenClaims struct {
+	jwt.StandardClaims
+	Audience          oidcAudience `json:"aud"`
+	Nonce             string       `json:"nonce"`
+	Email             string       `json:"email"`
+	EmailVerified     bool         `json:"email_verified"`
+	PreferredUsername string       `json:"preferred_username"`
+}
+
+const (
+	oidcStateLifespan = time.Minute * 10
+	maxUsernameTries  = 5
+)
+
+var oidcProviders = map[string]*OIDCProvider{}
+
+var oidcClient = &http.Client{Timeout: time.Second * 10}
+
+var rxUsernameUnsafe = regexp.MustCompile(`[^a-zA-Z0-9_]+`)
+
+var (
+	errOIDCState     = errors.New("Invalid state")
+	errOIDCCode      = errors.New("Invalid authorization code")
+	errEmailRequired = errors.New("Email required")
+)
+
+// UnmarshalJSON accepts either a single audience or many.
+func (a *oidcAudience) UnmarshalJSON(b []byte) error {
+	var single string
+	if err := json.Unmarshal(b, &single); err == nil {
+		*a = oidcAudience{single}
+		return nil
+	}
+	var many []string
+	if err := json.Unmarshal(b, &many); err != nil {
+		return err
+	}
+	*a = many
+	return nil
+}
+
+func (a oidcAudience) contains(aud string) bool {
+	for _, s := range a {
+		if s == aud {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *OIDCProvider) redirectURL() string {
+	return origin + "/oidc/" + p.Name + "/callback"
+}
+
+func (p *OIDCProvider) cookieName() string {
+	return "oidc_" + p.Name
+}
+
+// discover fetches the provider configuration once.
+func (p *OIDCProvider) discover(ctx context.Context) (*oidcConfig, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.config != nil {
+		return p.config, nil
+	}
+
+	var config oidcConfig
+	if err := getJSON(ctx, strings.TrimSuffix(p.Issuer, "/")+"/.well-known/openid-configuration", &config); err != nil {
+		return nil, err
+	}
+
+	if config.Issuer != p.Issuer {
+		return nil, fmt.Errorf("issuer mismatch: %q", config.Issuer)
+	}
+
+	p.config = &config
+	return p.config, nil
+}
+
+// key returns the verification key of the given id,
+// fetching the provider keys again if unknown, as they could have been rotated.
+func (p *OIDCProvider) key(ctx context.Context, kid string) (interface{}, error) {
+	config, err := p.discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if key, ok := p.keys[kid]; ok {
+		return key, nil
+	}
+
+	var jwks struct {
+		Keys []struct {
+			KeyType string `json:"kty"`
+			KeyID   string `json:"kid"`
+			Curve   string `json:"crv"`
+			N       string `json:"n"`
+			E       string `json:"e"`
+			X       string `json:"x"`
+			Y       string `json:"y"`
+		} `json:"keys"`
+	}
+	if err := getJSON(ctx, config.JWKSURI, &jwks); err != nil {
+		return nil, err
+	}
+
+	p.keys = map[string]interface{}{}
+	for _, k := range jwks.Keys {
+		switch {
+		case k.KeyType == "RSA":
+			n, errN := base64.RawURLEncoding.DecodeString(k.N)
+			e, errE := base64.RawURLEncoding.DecodeString(k.E)
+			if errN != nil || errE != nil {
+				continue
+			}
+			p.keys[k.KeyID] = &rsa.PublicKey{
+				N: new(big.Int).SetBytes(n),
+				E: int(new(big.Int).SetBytes(e).Int64()),
+			}
+		case k.KeyType == "EC" && k.Curve == "P-256":
+			x, errX := base64.RawURLEncoding.DecodeString(k.X)
+			y, errY := base64.RawURLEncoding.DecodeString(k.Y)
+			if errX != nil || errY != nil {
+				continue
+			}
+			p.keys[k.KeyID] = &ecdsa.PublicKey{
+				Curve: elliptic.P256(),
+				X:     new(big.Int).SetBytes(x),
+				Y:     new(big.Int).SetBytes(y),
+			}
+		}
+	}
+
+	key, ok := p.keys[kid]
+	if !ok {
+		return nil, errUnknownKey
+	}
+	return key, nil
+}
+
+// exchange the authorization code for the verified ID token claims.
+// A code the provider rejects, or whose ID token doesn't verify, is errOIDCCode.
+func (p *OIDCProvider) exchange(ctx context.Context, code, codeVerifier, nonce string) (*idTokenClaims, error) {
+	config, err := p.discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", p.redirectURL())
+	form.Set("code_verifier", codeVerifier)
+	req, err := http.NewRequest(http.MethodPost, config.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	req.SetBasicAuth(url.QueryEscape(p.ClientID), url.QueryEscape(p.ClientSecret))
+	res, err := oidcClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		b, _ := ioutil.ReadAll(res.Body)
+		log.Printf("OIDC token endpoint responded with %d: %s\n", res.StatusCode, b)
+		if res.StatusCode >= 400 && res.StatusCode < 500 {
+			return nil, errOIDCCode
+		}
+		return nil, fmt.Errorf("token endpoint responded with %d", res.StatusCode)
+	}
+
+	var tokenResponse oidcTokenResponse
+	if err := json.NewDecoder(res.Body).Decode(&tokenResponse); err != nil {
+		return nil, err
+	}
+
+	parser := jwt.Parser{ValidMethods: []string{
+		jwt.SigningMethodRS256.Name,
+		jwt.SigningMethodES256.Name,
+	}}
+	var claims idTokenClaims
+	if _, err := parser.ParseWithClaims(tokenResponse.IDToken, &claims, func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		return p.key(ctx, kid)
+	}); err != nil {
+		log.Printf("invalid OIDC ID token: %v\n", err)
+		return nil, errOIDCCode
+	}
+
+	if claims.Issuer != config.Issuer ||
+		!claims.Audience.contains(p.ClientID) ||
+		claims.Nonce != nonce ||
+		claims.Subject == "" {
+		return nil, errOIDCCode
+	}
+
+	return &claims, nil
+}
+
+func getJSON(ctx context.Context, rawURL string, v interface{}) error {
+	req, err := http.NewRequest(http.MethodGet, rawURL, nil)
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Accept", "application/json")
+	res, err := oidcClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s responded with %d", rawURL, res.StatusCode)
+	}
+
+	return json.NewDecoder(res.Body).Decode(v)
+}
+
+func getOIDCProviders(w http.ResponseWriter, r *http.Request) {
+	names := make([]string, 0, len(oidcProviders))
+	for name := range oidcProviders {
+		names = append(names, name)
+	}
+	respondJSON(w, names, http.StatusOK)
+}
+
+func oidcLogin(w http.ResponseWriter, r *http.Request) {
+	provider, ok := oidcProviders[chi.URLParam(r, "provider")]
+	if !ok {
+		http.Error(w,
+			http.StatusText(http.StatusNotFound),
+			http.StatusNotFound)
+		return
+	}
+
+	config, err := provider.discover(r.Context())
+	if err != nil {
+		respondError(w, fmt.Errorf("could not discover OIDC provider: %v", err))
+		return
+	}
+
+	var state, nonce, codeVerifier string
+	for _, s := range []*string{&state, &nonce, &codeVerifier} {
+		if *s, err = randomString(); err != nil {
+			respondError(w, fmt.Errorf("could not generate OIDC state: %v", err))
+			return
+		}
+	}
+
+	// Whatever the callback needs to verify the response
+	// stays in the browser that started the flow.
+	setCookie(w, provider.cookieName(),
+		strings.Join([]string{state, nonce, codeVerifier}, "."),
+		"/api/oidc/"+provider.Name,
+		time.Now().Add(oidcStateLifespan),
+		true)
+
+	challenge := sha256.Sum256([]byte(codeVerifier))
+	q := url.Values{}
+	q.Set("response_type", "code")
+	q.Set("client_id", provider.ClientID)
+	q.Set("redirect_uri", provider.redirectURL())
+	q.Set("scope", "openid email profile")
+	q.Set("state", state)
+	q.Set("nonce", nonce)
+	q.Set("code_challenge", base64.RawURLEncoding.EncodeToString(challenge[:]))
+	q.Set("code_challenge_method", "S256")
+
+	authURL := config.AuthorizationEndpoint
+	if strings.Contains(authURL, "?") {
+		authURL += "&" + q.Encode()
+	} else {
+		authURL += "?" + q.Encode()
+	}
+
+	http.Redirect(w, r, authURL, http.StatusFound)
+}
+
+func oidcCallback(w http.ResponseWriter, r *http.Request) {
+	provider, ok := oidcProviders[chi.URLParam(r, "provider")]
+	if !ok {
+		http.Error(w,
+			http.StatusText(http.StatusNotFound),
+			http.StatusNotFound)
+		return
+	}
+
+	q := r.URL.Query()
+	if errMsg := q.Get("error"); errMsg != "" {
+		http.Error(w, errMsg, http.StatusUnauthorized)
+		return
+	}
+
+	c, err := r.Cookie(provider.cookieName())
+	if err != nil {
+		http.Error(w, errOIDCState.Error(), http.StatusBadRequest)
+		return
+	}
+
+	expireCookie(w, provider.cookieName(), "/api/oidc/"+provider.Name)
+
+	parts := strings.Split(c.Value, ".")
+	if len(parts) != 3 || q.Get("state") != parts[0] {
+		http.Error(w, errOIDCState.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ctx := r.Context()
+	claims, err := provider.exchange(ctx, q.Get("code"), parts[2], parts[1])
+	if err == errOIDCCode {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	} else if err != nil {
+		respondError(w, fmt.Errorf("could not exchange OIDC code: %v", err))
+		return
+	}
+
+	user, err := oidcUser(ctx, provider.Name, claims)
+	if err == errEmailRequired {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	} else if err != nil {
+		respondError(w, fmt.Errorf("could not get OIDC user: %v", err))
+		return
+	}
+
+	completeLogin(w, r, user)
+}
+
+// oidcUser returns the user linked to the provider subject.
+// Not linked yet, it links the user with the same verified email
+// or creates a new one.
+func oidcUser(ctx context.Context, providerName string, claims *idTokenClaims) (User, error) {
+	var user User
+	err := db.QueryRowContext(ctx, `
+		SELECT users.id, users.username, users.avatar_url
+		FROM identities
+		INNER JOIN users ON identities.user_id = users.id
+		WHERE identities.provider = $1 AND identities.subject = $2
+	`, providerName, claims.Subject).Scan(&user.ID, &user.Username, &user.AvatarURL)
+	if err != sql.ErrNoRows {
+		return user, err
+	}
+
+	if claims.Email == "" || !claims.EmailVerified {
+		return user, errEmailRequired
+	}
+
+	err = db.QueryRowContext(ctx, "SELECT id, username, avatar_url FROM users WHERE email = $1", claims.Email).
+		Scan(&user.ID, &user.Username, &user.AvatarURL)
+	if err == sql.ErrNoRows {
+		user, err = createOIDCUser(ctx, claims)
+	}
+	if err != nil {
+		return user, err
+	}
+
+	// The provider vouches for the email.
+	if err = markEmailVerified(ctx, db, user.ID, claims.Email); err != nil {
+		return user, err
+	}
+	userCache.Invalidate(user.ID)
+
+	_, err = db.ExecContext(ctx, `
+		INSERT INTO identities (provider, subject, user_id) VALUES ($1, $2, $3)
+		RETURNING NOTHING
+	`, providerName, claims.Subject, user.ID)
+	return user, err
+}
+
+// createOIDCUser with a username based on the preferred one or the email,
+// adding a random suffix while taken.
+func createOIDCUser(ctx context.Context, claims *idTokenClaims) (User, error) {
+	base := oidcUsernameBase(claims)
+	username := base
+	for i := 0; i < maxUsernameTries; i++ {
+		userID, _, err := insertUser(ctx, claims.Email, username, nil)
+		if err == errUsernameTaken {
+			n, err := rand.Int(rand.Reader, big.NewInt(10000))
+			if err != nil {
+				return User{}, err
+			}
+			username = fmt.Sprintf("%s_%d", base, n)
+			continue
+		}
+		if err != nil {
+			return User{}, err
+		}
+		return User{ID: userID, Username: username}, nil
+	}
+
+	return User{}, errUsernameTaken
+}
+
+// oidcUsernameBase makes a valid username out of the preferred one
+// or the local part of the email.
+func oidcUsernameBase(claims *idTokenClaims) string {
+	base := claims.PreferredUsername
+	if base == "" {
+		base = claims.Email
+		if i := strings.Index(base, "@"); i != -1 {
+			base = base[:i]
+		}
+	}
+	base = rxUsernameUnsafe.ReplaceAllString(base, "_")
+	// Leaves room for the suffix.
+	if len(base) > 24 {
+		base = base[:24]
+	}
+	if base == "" || base == "_" {
+		base = "user"
+	}
+	return base
+}
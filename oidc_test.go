@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/go-chi/chi"
+)
+
+const (
+	mockOIDCClientID = "nakama"
+	mockOIDCCode     = "good-code"
+	mockOIDCKeyID    = "mock-key"
+)
+
+// mockOIDCProvider serves discovery, keys and a token endpoint
+// that only accepts mockOIDCCode, once.
+type mockOIDCProvider struct {
+	*httptest.Server
+	key    *rsa.PrivateKey
+	nonce  string
+	claims idTokenClaims
+	used   bool
+}
+
+func newMockOIDCProvider(t *testing.T) *mockOIDCProvider {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := &mockOIDCProvider{key: key}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(oidcConfig{
+			Issuer:                m.URL,
+			AuthorizationEndpoint: m.URL + "/authorize",
+			TokenEndpoint:         m.URL + "/token",
+			JWKSURI:               m.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"keys": []map[string]string{{
+				"kty": "RSA",
+				"kid": mockOIDCKeyID,
+				"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+			}},
+		})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		if r.PostFormValue("code") != mockOIDCCode || m.used {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error":"invalid_grant","error_description":"secret provider details"}`))
+			return
+		}
+		m.used = true
+
+		token := jwt.NewWithClaims(jwt.SigningMethodRS256, m.claims)
+		token.Header["kid"] = mockOIDCKeyID
+		idToken, err := token.SignedString(key)
+		if err != nil {
+			t.Error(err)
+		}
+		json.NewEncoder(w).Encode(oidcTokenResponse{IDToken: idToken})
+	})
+	m.Server = httptest.NewServer(mux)
+
+	m.claims = idTokenClaims{
+		StandardClaims: jwt.StandardClaims{
+			Issuer:    m.URL,
+			Subject:   "subject",
+			ExpiresAt: time.Now().Add(time.Minute).Unix(),
+		},
+		Audience:      oidcAudience{mockOIDCClientID},
+		Nonce:         "nonce",
+		Email:         "john@example.org",
+		EmailVerified: true,
+	}
+	return m
+}
+
+func (m *mockOIDCProvider) provider() *OIDCProvider {
+	return &OIDCProvider{
+		Name:     "mock",
+		Issuer:   m.URL,
+		ClientID: mockOIDCClientID,
+	}
+}
+
+func TestOIDCExchange(t *testing.T) {
+	m := newMockOIDCProvider(t)
+	defer m.Close()
+	p := m.provider()
+	ctx := context.Background()
+
+	claims, err := p.exchange(ctx, mockOIDCCode, "verifier", "nonce")
+	if err != nil {
+		t.Fatalf("exchange: %v", err)
+	}
+	if claims.Subject != "subject" || claims.Email != "john@example.org" {
+		t.Errorf("unexpected claims: %+v", claims)
+	}
+
+	if _, err := p.exchange(ctx, mockOIDCCode, "verifier", "nonce"); err != errOIDCCode {
+		t.Errorf("replayed code: got %v, want %v", err, errOIDCCode)
+	}
+
+	if _, err := p.exchange(ctx, "bad-code", "verifier", "nonce"); err != errOIDCCode {
+		t.Errorf("bad code: got %v, want %v", err, errOIDCCode)
+	}
+
+	m.used = false
+	if _, err := p.exchange(ctx, mockOIDCCode, "verifier", "other-nonce"); err != errOIDCCode {
+		t.Errorf("wrong nonce: got %v, want %v", err, errOIDCCode)
+	}
+
+	m.used = false
+	m.claims.ExpiresAt = time.Now().Add(-time.Minute).Unix()
+	if _, err := p.exchange(ctx, mockOIDCCode, "verifier", "nonce"); err != errOIDCCode {
+		t.Errorf("expired ID token: got %v, want %v", err, errOIDCCode)
+	}
+}
+
+func TestOIDCCallbackRejectsBadCode(t *testing.T) {
+	m := newMockOIDCProvider(t)
+	defer m.Close()
+	oidcProviders["mock"] = m.provider()
+	defer delete(oidcProviders, "mock")
+
+	router := chi.NewRouter()
+	router.Get("/oidc/{provider}/callback", oidcCallback)
+
+	req := httptest.NewRequest(http.MethodGet, "/oidc/mock/callback?state=state&code=bad-code", nil)
+	req.AddCookie(&http.Cookie{Name: "oidc_mock", Value: "state.nonce.verifier"})
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("got status %d, want %d", rec.Code, http.StatusUnauthorized)
+	}
+	if strings.Contains(rec.Body.String(), "secret provider details") {
+		t.Errorf("provider response leaked: %q", rec.Body.String())
+	}
+}
+
+func TestOIDCUsernameBase(t *testing.T) {
+	tests := []struct {
+		claims idTokenClaims
+		want   string
+	}{
+		{idTokenClaims{PreferredUsername: "john.doe", Email: "john@example.org"}, "john_doe"},
+		{idTokenClaims{Email: "john@example.org"}, "john"},
+		{idTokenClaims{Email: "john"}, "john"},
+		{idTokenClaims{Email: "@example.org"}, "user"},
+		{idTokenClaims{}, "user"},
+		{idTokenClaims{PreferredUsername: strings.Repeat("a", 30)}, strings.Repeat("a", 24)},
+	}
+	for _, tt := range tests {
+		if got := oidcUsernameBase(&tt.claims); got != tt.want {
+			t.Errorf("oidcUsernameBase(%+v) = %q, want %q", tt.claims, got, tt.want)
+		}
+	}
+}
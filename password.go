@@ -0,0 +1,292 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/cockroachdb/cockroach-go/crdb"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// ChangePasswordInput request body
+type ChangePasswordInput struct {
+	CurrentPassword string `json:"currentPassword"`
+	NewPassword     string `json:"newPassword"`
+}
+
+// RequestPasswordResetInput request body
+type RequestPasswordResetInput struct {
+	Email string `json:"email"`
+}
+
+// ResetPasswordInput request body
+type ResetPasswordInput struct {
+	Token    string `json:"token"`
+	Password string `json:"password"`
+}
+
+const (
+	minPasswordLength          = 8
+	maxPasswordLength          = 72 // bcrypt ignores anything after 72 bytes.
+	passwordResetTokenLifespan = time.Hour
+)
+
+var errInvalidCredentials = errors.New("Invalid credentials")
+
+// dummyPasswordHash is compared against when the user doesn't exist,
+// so the response takes the same time either way.
+var dummyPasswordHash, _ = bcrypt.GenerateFromPassword([]byte("dummy password"), bcrypt.DefaultCost)
+
+func validatePassword(password string) string {
+	if len(password) < minPasswordLength {
+		return fmt.Sprintf("Password must be at least %d characters long", minPasswordLength)
+	}
+	if len(password) > maxPasswordLength {
+		return fmt.Sprintf("Password must be at most %d bytes long", maxPasswordLength)
+	}
+	return ""
+}
+
+func hashPassword(password string) ([]byte, error) {
+	return bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+}
+
+func passwordLogin(w http.ResponseWriter, r *http.Request, email, password, throttleKey string) {
+	var user User
+	var passwordHash []byte
+	if err := db.QueryRowContext(r.Context(), `
+		SELECT id, username, avatar_url, password_hash
+		FROM users
+		WHERE email = $1
+	`, email).Scan(
+		&user.ID,
+		&user.Username,
+		&user.AvatarURL,
+		&passwordHash,
+	); err != nil && err != sql.ErrNoRows {
+		respondError(w, fmt.Errorf("could not query user to login: %v", err))
+		return
+	}
+
+	// Users created without password have a null hash.
+	// They get the same response as a wrong password or a nonexistent email.
+	if passwordHash == nil {
+		bcrypt.CompareHashAndPassword(dummyPasswordHash, []byte(password))
+	}
+
+	if passwordHash == nil || bcrypt.CompareHashAndPassword(passwordHash, []byte(password)) != nil {
+		recordSecurityEvent(r, user.ID, eventLogin, outcomeFailure)
+		http.Error(w, errInvalidCredentials.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	// The attempt was counted before checking the password.
+	// Only the email is forgiven; the IP could still be trying other accounts.
+	if err := loginThrottler.Reset(throttleKey); err != nil {
+		log.Printf("could not reset login throttle: %v\n", err)
+	}
+
+	completeLogin(w, r, user)
+}
+
+func changePassword(w http.ResponseWriter, r *http.Request) {
+	var input ChangePasswordInput
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer r.Body.Close()
+
+	if msg := validatePassword(input.NewPassword); msg != "" {
+		respondJSON(w, map[string]string{
+			"newPassword": msg,
+		}, http.StatusUnprocessableEntity)
+		return
+	}
+
+	ctx := r.Context()
+	authUserID := ctx.Value(keyAuthUserID).(string)
+	sessionID := ctx.Value(keySessionID).(string)
+
+	newPasswordHash, err := hashPassword(input.NewPassword)
+	if err != nil {
+		respondError(w, fmt.Errorf("could not hash password: %v", err))
+		return
+	}
+
+	if err := crdb.ExecuteTx(ctx, db, nil, func(tx *sql.Tx) error {
+		var passwordHash []byte
+		if err := tx.QueryRow("SELECT password_hash FROM users WHERE id = $1", authUserID).
+			Scan(&passwordHash); err != nil {
+			return err
+		}
+
+		// Users without password can set one without knowing the current.
+		if passwordHash != nil {
+			if err := bcrypt.CompareHashAndPassword(passwordHash, []byte(input.CurrentPassword)); err != nil {
+				return errInvalidCredentials
+			}
+		}
+
+		if _, err := tx.Exec(`
+			UPDATE users SET password_hash = $1
+			WHERE id = $2
+			RETURNING NOTHING
+		`, newPasswordHash, authUserID); err != nil {
+			return err
+		}
+
+		// Every other session is logged out.
+		return revokeUserSessions(ctx, tx, authUserID, sessionID)
+	}); err == errInvalidCredentials {
+		recordSecurityEvent(r, authUserID, eventPasswordChanged, outcomeFailure)
+		respondJSON(w, map[string]string{
+			"currentPassword": "Wrong password",
+		}, http.StatusUnprocessableEntity)
+		return
+	} else if err != nil {
+		respondError(w, fmt.Errorf("could not change password: %v", err))
+		return
+	}
+
+	recordSecurityEvent(r, authUserID, eventPasswordChanged, outcomeSuccess)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func requestPasswordReset(w http.ResponseWriter, r *http.Request) {
+	var input RequestPasswordResetInput
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer r.Body.Close()
+
+	email := strings.TrimSpace(input.Email)
+	if !rxEmail.MatchString(email) {
+		respondJSON(w, map[string]string{
+			"email": "Invalid email",
+		}, http.StatusUnprocessableEntity)
+		return
+	}
+
+	throttleKeys := []string{ipThrottleKey("reset_password", r), emailThrottleKey("reset_password", email)}
+	if throttled(w, loginThrottler, throttleKeys...) {
+		return
+	}
+
+	ctx := r.Context()
+	var userID string
+	if err := db.QueryRowContext(ctx, "SELECT id FROM users WHERE email = $1", email).
+		Scan(&userID); err == sql.ErrNoRows {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	} else if err != nil {
+		respondError(w, fmt.Errorf("could not query user to reset password: %v", err))
+		return
+	}
+
+	token, tokenHash, err := genToken()
+	if err != nil {
+		respondError(w, fmt.Errorf("could not generate password reset token: %v", err))
+		return
+	}
+
+	if _, err := db.ExecContext(ctx, `
+		INSERT INTO password_reset_tokens (token_hash, user_id, expires_at) VALUES ($1, $2, $3)
+		RETURNING NOTHING
+	`, tokenHash, userID, time.Now().Add(passwordResetTokenLifespan)); err != nil {
+		respondError(w, fmt.Errorf("could not insert password reset token: %v", err))
+		return
+	}
+
+	go sendPasswordResetLink(email, token)
+
+	recordSecurityEvent(r, userID, eventPasswordResetRequested, outcomeSuccess)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func sendPasswordResetLink(email, token string) {
+	link := origin + "/reset_password?token=" + url.QueryEscape(token)
+	if err := mailer.Send(email, "Reset your Nakama password", fmt.Sprintf(
+		"Click the link below to choose a new password.\n\n%s\n\nIt expires in %s and can be used only once.\n"+
+			"If you didn't ask for it, just ignore this email.\n",
+		link, passwordResetTokenLifespan)); err != nil {
+		log.Printf("could not send password reset link: %v\n", err)
+	}
+}
+
+func resetPassword(w http.ResponseWriter, r *http.Request) {
+	var input ResetPasswordInput
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer r.Body.Close()
+
+	if msg := validatePassword(input.Password); msg != "" {
+		respondJSON(w, map[string]string{
+			"password": msg,
+		}, http.StatusUnprocessableEntity)
+		return
+	}
+
+	passwordHash, err := hashPassword(input.Password)
+	if err != nil {
+		respondError(w, fmt.Errorf("could not hash password: %v", err))
+		return
+	}
+
+	ctx := r.Context()
+	var userID string
+	if err := crdb.ExecuteTx(ctx, db, nil, func(tx *sql.Tx) error {
+		var expiresAt time.Time
+		if err := tx.QueryRow(`
+			DELETE FROM password_reset_tokens WHERE token_hash = $1
+			RETURNING user_id, expires_at
+		`, hashToken(input.Token)).Scan(&userID, &expiresAt); err != nil {
+			return err
+		}
+
+		if expiresAt.Before(time.Now()) {
+			return sql.ErrNoRows
+		}
+
+		if _, err := tx.Exec(`
+			DELETE FROM password_reset_tokens WHERE user_id = $1
+			RETURNING NOTHING
+		`, userID); err != nil {
+			return err
+		}
+
+		// Whoever knew the old password is logged out.
+		if err := revokeUserSessions(ctx, tx, userID, ""); err != nil {
+			return err
+		}
+
+		_, err := tx.Exec(`
+			UPDATE users SET password_hash = $1
+			WHERE id = $2
+			RETURNING NOTHING
+		`, passwordHash, userID)
+		return err
+	}); err == sql.ErrNoRows {
+		http.Error(w, "Invalid or expired token", http.StatusUnauthorized)
+		return
+	} else if err != nil {
+		respondError(w, fmt.Errorf("could not reset password: %v", err))
+		return
+	}
+
+	recordSecurityEvent(r, userID, eventPasswordReset, outcomeSuccess)
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/lib/pq"
+)
+
+// CreatePersonalTokenInput request body
+type CreatePersonalTokenInput struct {
+	Name      string     `json:"name"`
+	Scopes    []string   `json:"scopes"`
+	ExpiresAt *time.Time `json:"expiresAt,omitempty"`
+}
+
+// PersonalToken model
+type PersonalToken struct {
+	ID         string     `json:"id"`
+	Name       string     `json:"name"`
+	Scopes     []string   `json:"scopes"`
+	Token      string     `json:"token,omitempty"`
+	LastUsedAt *time.Time `json:"lastUsedAt"`
+	ExpiresAt  *time.Time `json:"expiresAt"`
+	CreatedAt  time.Time  `json:"createdAt"`
+}
+
+// Scopes personal tokens can be granted.
+const (
+	scopeFeedRead          = "feed:read"
+	scopePostsWrite        = "posts:write"
+	scopeCommentsWrite     = "comments:write"
+	scopeFollowsWrite      = "follows:write"
+	scopeNotificationsRead = "notifications:read"
+)
+
+const personalTokenPrefix = "nkm_"
+
+var validScopes = map[string]bool{
+	scopeFeedRead:          true,
+	scopePostsWrite:        true,
+	scopeCommentsWrite:     true,
+	scopeFollowsWrite:      true,
+	scopeNotificationsRead: true,
+}
+
+// personalTokenAuth resolves the user and scopes of a personal token,
+// and whether the user is suspended.
+func personalTokenAuth(ctx context.Context, token string) (string, []string, bool, error) {
+	var tokenID, userID string
+	var scopes []string
+	var lastUsedAt *time.Time
+	var suspended bool
+	if err := db.QueryRowContext(ctx, `
+		SELECT personal_tokens.id, personal_tokens.user_id, personal_tokens.scopes, personal_tokens.last_used_at, `+sqlUserSuspended+`
+		FROM personal_tokens
+		INNER JOIN users ON personal_tokens.user_id = users.id
+		WHERE personal_tokens.token_hash = $1
+			AND (personal_tokens.expires_at IS NULL OR personal_tokens.expires_at > now())
+	`, hashToken(token)).Scan(&tokenID, &userID, pq.Array(&scopes), &lastUsedAt, &suspended); err != nil {
+		return "", nil, false, err
+	}
+
+	if lastUsedAt == nil || time.Since(*lastUsedAt) > sessionTouchInterval {
+		go touchPersonalToken(tokenID)
+	}
+
+	return userID, scopes, suspended, nil
+}
+
+func touchPersonalToken(tokenID string) {
+	if _, err := db.Exec("UPDATE personal_tokens SET last_used_at = now() WHERE id = $1", tokenID); err != nil {
+		log.Printf("could not touch personal token: %v\n", err)
+	}
+}
+
+// requireScope lets through session authenticated requests
+// and personal tokens granted the given scope.
+func requireScope(scope string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if scopes, ok := r.Context().Value(keyAuthScopes).([]string); ok {
+				granted := false
+				for _, s := range scopes {
+					if s == scope {
+						granted = true
+						break
+					}
+				}
+				if !granted {
+					http.Error(w, "Missing scope "+scope, http.StatusForbidden)
+					return
+				}
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// requireSession rejects personal tokens
+// so they can't be used to manage the account.
+func requireSession(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := r.Context().Value(keyAuthScopes).([]string); ok {
+			http.Error(w, "Personal tokens not allowed", http.StatusForbidden)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+func createPersonalToken(w http.ResponseWriter, r *http.Request) {
+	var input CreatePersonalTokenInput
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer r.Body.Close()
+
+	name := strings.TrimSpace(input.Name)
+	errs := map[string]string{}
+	if name == "" || len(name) > 100 {
+		errs["name"] = "Name must be between 1 and 100 characters long"
+	}
+	if len(input.Scopes) == 0 {
+		errs["scopes"] = "At least one scope required"
+	}
+	for _, scope := range input.Scopes {
+		if !validScopes[scope] {
+			errs["scopes"] = "Invalid scope " + scope
+			break
+		}
+	}
+	if input.ExpiresAt != nil && input.ExpiresAt.Before(time.Now()) {
+		errs["expiresAt"] = "Expiration must be in the future"
+	}
+	if len(errs) != 0 {
+		respondJSON(w, errs, http.StatusUnprocessableEntity)
+		return
+	}
+
+	random, err := randomString()
+	if err != nil {
+		respondError(w, fmt.Errorf("could not generate personal token: %v", err))
+		return
+	}
+
+	ctx := r.Context()
+	authUserID := ctx.Value(keyAuthUserID).(string)
+	token := PersonalToken{
+		Name:      name,
+		Scopes:    input.Scopes,
+		Token:     personalTokenPrefix + random,
+		ExpiresAt: input.ExpiresAt,
+	}
+	if err := db.QueryRowContext(ctx, `
+		INSERT INTO personal_tokens (user_id, name, token_hash, scopes, expires_at)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING id, created_at
+	`, authUserID, name, hashToken(token.Token), pq.Array(token.Scopes), token.ExpiresAt).
+		Scan(&token.ID, &token.CreatedAt); err != nil {
+		respondError(w, fmt.Errorf("could not insert personal token: %v", err))
+		return
+	}
+
+	recordSecurityEvent(r, authUserID, eventPersonalTokenCreated, outcomeSuccess)
+
+	// This is the only time the token is shown.
+	respondJSON(w, token, http.StatusCreated)
+}
+
+func getPersonalTokens(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	authUserID := ctx.Value(keyAuthUserID).(string)
+
+	rows, err := db.QueryContext(ctx, `
+		SELECT id, name, scopes, last_used_at, expires_at, created_at
+		FROM personal_tokens
+		WHERE user_id = $1
+		ORDER BY created_at DESC
+	`, authUserID)
+	if err != nil {
+		respondError(w, fmt.Errorf("could not query personal tokens: %v", err))
+		return
+	}
+	defer rows.Close()
+
+	tokens := make([]PersonalToken, 0)
+	for rows.Next() {
+		var token PersonalToken
+		if err = rows.Scan(
+			&token.ID,
+			&token.Name,
+			pq.Array(&token.Scopes),
+			&token.LastUsedAt,
+			&token.ExpiresAt,
+			&token.CreatedAt,
+		); err != nil {
+			respondError(w, fmt.Errorf("could not scan personal token: %v", err))
+			return
+		}
+
+		tokens = append(tokens, token)
+	}
+	if err = rows.Err(); err != nil {
+		respondError(w, fmt.Errorf("could not iterate over personal tokens: %v", err))
+		return
+	}
+
+	respondJSON(w, tokens, http.StatusOK)
+}
+
+func deletePersonalToken(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	authUserID := ctx.Value(keyAuthUserID).(string)
+	tokenID := chi.URLParam(r, "token_id")
+
+	result, err := db.ExecContext(ctx, `
+		DELETE FROM personal_tokens
+		WHERE id::STRING = $1 AND user_id = $2
+	`, tokenID, authUserID)
+	if err != nil {
+		respondError(w, fmt.Errorf("could not delete personal token: %v", err))
+		return
+	}
+
+	if n, err := result.RowsAffected(); err != nil {
+		respondError(w, fmt.Errorf("could not delete personal token: %v", err))
+		return
+	} else if n == 0 {
+		http.Error(w,
+			http.StatusText(http.StatusNotFound),
+			http.StatusNotFound)
+		return
+	}
+
+	recordSecurityEvent(r, authUserID, eventPersonalTokenDeleted, outcomeSuccess)
+
+	w.WriteHeader(http.StatusNoContent)
+}
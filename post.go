@@ -38,6 +38,27 @@ type TogglePostLikePayload struct {
 	LikesCount int  `json:"likesCount"`
 }
 
+// checkPostVisible returns sql.ErrNoRows unless the post exists
+// and the user can see it: the author is public or followed,
+// and neither blocked the other.
+// So writes on hidden posts look like on missing ones.
+func checkPostVisible(tx *sql.Tx, postID, userID string) error {
+	var visible bool
+	if err := tx.QueryRow(`
+		SELECT `+sqlUserVisibleTo("$2")+`
+		FROM posts
+		INNER JOIN users ON posts.user_id = users.id
+		WHERE posts.id = $1
+	`, postID, userID).Scan(&visible); err != nil {
+		return err
+	}
+
+	if !visible {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
 func createPost(w http.ResponseWriter, r *http.Request) {
 	var input CreatePostInput
 	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
@@ -108,7 +129,9 @@ func getPosts(w http.ResponseWriter, r *http.Request) {
 			posts.comments_count,
 			posts.created_at`
 	args := []interface{}{username}
+	visibleTo := ""
 	if authenticated {
+		visibleTo = "$2"
 		query += `,
 			posts.user_id = $2 AS mine,
 			likes.user_id IS NOT NULL AS liked,
@@ -128,7 +151,10 @@ func getPosts(w http.ResponseWriter, r *http.Request) {
 	}
 	query += `
 		WHERE posts.user_id = (
-			SELECT id FROM users WHERE username = $1
+			SELECT id FROM users
+			WHERE username = $1
+				AND NOT ` + sqlUserSuspended + `
+				AND ` + sqlUserVisibleTo(visibleTo) + `
 		)
 		ORDER BY posts.created_at DESC`
 
@@ -188,7 +214,9 @@ func getPost(w http.ResponseWriter, r *http.Request) {
 			users.username,
 			users.avatar_url`
 	args := []interface{}{postID}
+	visibleTo := ""
 	if authenticated {
+		visibleTo = "$2"
 		query += `,
 			posts.user_id = $2 AS mine,
 			EXISTS (
@@ -204,7 +232,9 @@ func getPost(w http.ResponseWriter, r *http.Request) {
 	query += `
 		FROM posts
 		INNER JOIN users ON posts.user_id = users.id
-		WHERE posts.id = $1`
+		WHERE posts.id = $1
+			AND NOT ` + sqlUserSuspended + `
+			AND ` + sqlUserVisibleTo(visibleTo)
 	var user User
 	var post Post
 	dest := []interface{}{
@@ -248,6 +278,9 @@ func togglePostLike(w http.ResponseWriter, r *http.Request) {
 	var liked bool
 	var likesCount int
 	if err := crdb.ExecuteTx(ctx, db, nil, func(tx *sql.Tx) error {
+		if err := checkPostVisible(tx, postID, authUserID); err != nil {
+			return err
+		}
 
 		if err := tx.QueryRow(`SELECT EXISTS (
 			SELECT 1 FROM post_likes
@@ -284,7 +317,12 @@ func togglePostLike(w http.ResponseWriter, r *http.Request) {
 			WHERE id = $1
 			RETURNING likes_count
 		`, postID).Scan(&likesCount)
-	}); err != nil {
+	}); err == sql.ErrNoRows {
+		http.Error(w,
+			http.StatusText(http.StatusNotFound),
+			http.StatusNotFound)
+		return
+	} else if err != nil {
 		respondError(w, fmt.Errorf("could not toggle post like: %v", err))
 		return
 	}
@@ -301,6 +339,10 @@ func toggleSubscription(w http.ResponseWriter, r *http.Request) {
 
 	var subscribed bool
 	if err := crdb.ExecuteTx(ctx, db, nil, func(tx *sql.Tx) error {
+		if err := checkPostVisible(tx, postID, authUserID); err != nil {
+			return err
+		}
+
 		if err := tx.QueryRow(`SELECT EXISTS (
 			SELECT 1 FROM subscriptions
 			WHERE user_id = $1 AND post_id = $2
@@ -322,7 +364,12 @@ func toggleSubscription(w http.ResponseWriter, r *http.Request) {
 			RETURNING NOTHING
 		`, authUserID, postID)
 		return err
-	}); err != nil {
+	}); err == sql.ErrNoRows {
+		http.Error(w,
+			http.StatusText(http.StatusNotFound),
+			http.StatusNotFound)
+		return
+	} else if err != nil {
 		respondError(w, fmt.Errorf("could not toggle subscription: %v", err))
 		return
 	}
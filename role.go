@@ -0,0 +1,98 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/go-chi/chi"
+)
+
+// SetRoleInput request body
+type SetRoleInput struct {
+	Role string `json:"role"`
+}
+
+// Roles, from least to most privileged.
+const (
+	roleUser      = "user"
+	roleModerator = "moderator"
+	roleAdmin     = "admin"
+)
+
+var roleRanks = map[string]int{
+	roleUser:      0,
+	roleModerator: 1,
+	roleAdmin:     2,
+}
+
+// hasRole tells whether role is the given one or a more privileged one.
+func hasRole(role, required string) bool {
+	rank, ok := roleRanks[role]
+	return ok && rank >= roleRanks[required]
+}
+
+// requireRole lets through users with the given role or a more privileged one.
+// It must come after mustAuthUser.
+func requireRole(role string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			authUser, ok := r.Context().Value(keyAuthUser).(User)
+			if !ok || !hasRole(authUser.Role, role) {
+				http.Error(w,
+					http.StatusText(http.StatusForbidden),
+					http.StatusForbidden)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func setUserRole(w http.ResponseWriter, r *http.Request) {
+	var input SetRoleInput
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer r.Body.Close()
+
+	if _, ok := roleRanks[input.Role]; !ok {
+		respondJSON(w, map[string]string{
+			"role": "Invalid role",
+		}, http.StatusUnprocessableEntity)
+		return
+	}
+
+	ctx := r.Context()
+	authUser := ctx.Value(keyAuthUser).(User)
+	username := chi.URLParam(r, "username")
+
+	// So there is always an admin left.
+	if username == authUser.Username {
+		http.Error(w, "Try changing the role of someone else", http.StatusForbidden)
+		return
+	}
+
+	var userID string
+	if err := db.QueryRowContext(ctx, `
+		UPDATE users SET role = $1
+		WHERE username = $2
+		RETURNING id
+	`, input.Role, username).Scan(&userID); err == sql.ErrNoRows {
+		http.Error(w,
+			http.StatusText(http.StatusNotFound),
+			http.StatusNotFound)
+		return
+	} else if err != nil {
+		respondError(w, fmt.Errorf("could not update user role: %v", err))
+		return
+	}
+
+	userCache.Invalidate(userID)
+	recordSecurityEvent(r, userID, eventRoleChanged, outcomeSuccess)
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -5,18 +5,159 @@ SET DATABASE = nakama;
 CREATE TABLE IF NOT EXISTS users (
     id SERIAL NOT NULL PRIMARY KEY,
     email STRING NOT NULL UNIQUE,
+    email_verified_at TIMESTAMPTZ,
     username STRING NOT NULL UNIQUE,
     avatar_url STRING,
+    display_name STRING,
+    bio STRING,
+    private BOOL NOT NULL DEFAULT false,
+    role STRING NOT NULL CHECK (role IN ('user', 'moderator', 'admin')) DEFAULT 'user',
+    password_hash BYTES,
+    totp_secret BYTES,
+    totp_enabled BOOL NOT NULL DEFAULT false,
+    totp_last_step INT NOT NULL DEFAULT 0,
     followers_count INT NOT NULL CHECK (followers_count >= 0) DEFAULT 0,
     following_count INT NOT NULL CHECK (following_count >= 0) DEFAULT 0,
     created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
-    notifications_seen_at TIMESTAMPTZ NOT NULL DEFAULT now()
+    notifications_seen_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    delete_at TIMESTAMPTZ,
+    suspended_at TIMESTAMPTZ,
+    suspended_until TIMESTAMPTZ,
+    suspension_reason STRING,
+    banned_at TIMESTAMPTZ,
+    ban_reason STRING,
+    INDEX (delete_at)
+);
+
+CREATE TABLE IF NOT EXISTS login_tokens (
+    token_hash BYTES NOT NULL PRIMARY KEY,
+    user_id INT NOT NULL REFERENCES users,
+    expires_at TIMESTAMPTZ NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE TABLE IF NOT EXISTS password_reset_tokens (
+    token_hash BYTES NOT NULL PRIMARY KEY,
+    user_id INT NOT NULL REFERENCES users,
+    expires_at TIMESTAMPTZ NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    INDEX (user_id)
+);
+
+CREATE TABLE IF NOT EXISTS email_verification_tokens (
+    token_hash BYTES NOT NULL PRIMARY KEY,
+    user_id INT NOT NULL REFERENCES users,
+    email STRING NOT NULL,
+    expires_at TIMESTAMPTZ NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    INDEX (user_id)
+);
+
+CREATE TABLE IF NOT EXISTS email_changes (
+    token_hash BYTES NOT NULL PRIMARY KEY,
+    cancel_token_hash BYTES NOT NULL UNIQUE,
+    user_id INT NOT NULL REFERENCES users,
+    new_email STRING NOT NULL,
+    expires_at TIMESTAMPTZ NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    INDEX (user_id)
+);
+
+CREATE TABLE IF NOT EXISTS recovery_codes (
+    user_id INT NOT NULL REFERENCES users,
+    code_hash BYTES NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    PRIMARY KEY (user_id, code_hash)
+);
+
+CREATE TABLE IF NOT EXISTS sessions (
+    id UUID NOT NULL PRIMARY KEY DEFAULT gen_random_uuid(),
+    user_id INT NOT NULL REFERENCES users,
+    user_agent STRING NOT NULL,
+    ip STRING NOT NULL,
+    expires_at TIMESTAMPTZ NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    last_seen_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    INDEX (user_id)
+);
+
+CREATE TABLE IF NOT EXISTS refresh_tokens (
+    token_hash BYTES NOT NULL PRIMARY KEY,
+    session_id UUID NOT NULL REFERENCES sessions,
+    user_id INT NOT NULL REFERENCES users,
+    used_at TIMESTAMPTZ,
+    expires_at TIMESTAMPTZ NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    INDEX (session_id),
+    INDEX (user_id)
+);
+
+CREATE TABLE IF NOT EXISTS identities (
+    provider STRING NOT NULL,
+    subject STRING NOT NULL,
+    user_id INT NOT NULL REFERENCES users,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    PRIMARY KEY (provider, subject),
+    INDEX (user_id)
+);
+
+CREATE TABLE IF NOT EXISTS personal_tokens (
+    id SERIAL NOT NULL PRIMARY KEY,
+    user_id INT NOT NULL REFERENCES users,
+    name STRING NOT NULL,
+    token_hash BYTES NOT NULL UNIQUE,
+    scopes STRING[] NOT NULL,
+    last_used_at TIMESTAMPTZ,
+    expires_at TIMESTAMPTZ,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    INDEX (user_id)
+);
+
+CREATE TABLE IF NOT EXISTS security_events (
+    id SERIAL NOT NULL PRIMARY KEY,
+    user_id INT REFERENCES users,
+    actor_id INT REFERENCES users,
+    event STRING NOT NULL,
+    outcome STRING NOT NULL,
+    ip STRING NOT NULL,
+    user_agent STRING NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    INDEX (user_id, id DESC)
 );
 
 CREATE TABLE IF NOT EXISTS follows (
     follower_id INT NOT NULL REFERENCES users,
     following_id INT NOT NULL REFERENCES users,
-    PRIMARY KEY(follower_id, following_id)
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    PRIMARY KEY(follower_id, following_id),
+    INDEX (follower_id, created_at DESC, following_id DESC),
+    INDEX (following_id, created_at DESC, follower_id DESC)
+);
+
+CREATE TABLE IF NOT EXISTS follow_requests (
+    follower_id INT NOT NULL REFERENCES users,
+    following_id INT NOT NULL REFERENCES users,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    PRIMARY KEY (follower_id, following_id),
+    INDEX (following_id, created_at DESC)
+);
+
+CREATE TABLE IF NOT EXISTS blocks (
+    blocker_id INT NOT NULL REFERENCES users,
+    blocked_id INT NOT NULL REFERENCES users,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    PRIMARY KEY (blocker_id, blocked_id),
+    INDEX (blocked_id)
+);
+
+CREATE TABLE IF NOT EXISTS mutes (
+    muter_id INT NOT NULL REFERENCES users,
+    muted_id INT NOT NULL REFERENCES users,
+    notifications_only BOOL NOT NULL DEFAULT false,
+    expires_at TIMESTAMPTZ,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    PRIMARY KEY (muter_id, muted_id),
+    INDEX (muted_id)
 );
 
 CREATE TABLE IF NOT EXISTS posts (
@@ -75,9 +216,9 @@ CREATE TABLE IF NOT EXISTS notifications (
     INDEX (issued_at DESC)
 );
 
-INSERT INTO users (id, email, username) VALUES
-    (1, 'john@example.dev', 'john_doe'),
-    (2, 'jane@example.dev', 'jane_doe');
+INSERT INTO users (id, email, username, email_verified_at, role) VALUES
+    (1, 'john@example.dev', 'john_doe', now(), 'admin'),
+    (2, 'jane@example.dev', 'jane_doe', now(), 'user');
 INSERT INTO follows (follower_id, following_id) VALUES
     (2, 1);
 UPDATE users SET following_count = following_count + 1 WHERE id = 2;
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi"
+)
+
+// Session model
+type Session struct {
+	ID         string    `json:"id"`
+	UserID     string    `json:"-"`
+	UserAgent  string    `json:"userAgent"`
+	IP         string    `json:"ip"`
+	CreatedAt  time.Time `json:"createdAt"`
+	LastSeenAt time.Time `json:"lastSeenAt"`
+	Current    bool      `json:"current"`
+}
+
+// Sessions are touched at most once per this interval
+// so not every request becomes a write.
+const sessionTouchInterval = time.Minute
+
+var rxUUID = regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}$`)
+
+// queryRower is either *sql.DB or *sql.Tx.
+type queryRower interface {
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+func insertSession(ctx context.Context, q queryRower, r *http.Request, userID string) (string, error) {
+	var sessionID string
+	err := q.QueryRowContext(ctx, `
+		INSERT INTO sessions (user_id, user_agent, ip, expires_at) VALUES ($1, $2, $3, $4)
+		RETURNING id
+	`, userID, r.UserAgent(), clientIP(r), time.Now().Add(refreshTokenLifespan)).Scan(&sessionID)
+	return sessionID, err
+}
+
+// revokeSession deletes the session along with its refresh tokens.
+func revokeSession(ctx context.Context, e execer, sessionID string) error {
+	if _, err := e.ExecContext(ctx, `
+		DELETE FROM refresh_tokens WHERE session_id = $1
+		RETURNING NOTHING
+	`, sessionID); err != nil {
+		return err
+	}
+
+	_, err := e.ExecContext(ctx, `
+		DELETE FROM sessions WHERE id = $1
+		RETURNING NOTHING
+	`, sessionID)
+	return err
+}
+
+// revokeUserSessions deletes all the sessions of the given user
+// except the one with exceptSessionID, if any.
+func revokeUserSessions(ctx context.Context, e execer, userID, exceptSessionID string) error {
+	if _, err := e.ExecContext(ctx, `
+		DELETE FROM refresh_tokens
+		WHERE user_id = $1 AND session_id::STRING != $2
+		RETURNING NOTHING
+	`, userID, exceptSessionID); err != nil {
+		return err
+	}
+
+	_, err := e.ExecContext(ctx, `
+		DELETE FROM sessions
+		WHERE user_id = $1 AND id::STRING != $2
+		RETURNING NOTHING
+	`, userID, exceptSessionID)
+	return err
+}
+
+func touchSession(sessionID, ip string) {
+	if _, err := db.Exec(`
+		UPDATE sessions SET last_seen_at = now(), ip = $1
+		WHERE id = $2
+	`, ip, sessionID); err != nil {
+		log.Printf("could not touch session: %v\n", err)
+	}
+}
+
+func getSessions(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	authUserID := ctx.Value(keyAuthUserID).(string)
+	sessionID, _ := ctx.Value(keySessionID).(string)
+
+	rows, err := db.QueryContext(ctx, `
+		SELECT id, user_agent, ip, created_at, last_seen_at
+		FROM sessions
+		WHERE user_id = $1 AND expires_at > now()
+		ORDER BY last_seen_at DESC
+	`, authUserID)
+	if err != nil {
+		respondError(w, fmt.Errorf("could not query sessions: %v", err))
+		return
+	}
+	defer rows.Close()
+
+	sessions := make([]Session, 0)
+	for rows.Next() {
+		var session Session
+		if err = rows.Scan(
+			&session.ID,
+			&session.UserAgent,
+			&session.IP,
+			&session.CreatedAt,
+			&session.LastSeenAt,
+		); err != nil {
+			respondError(w, fmt.Errorf("could not scan session: %v", err))
+			return
+		}
+
+		session.Current = session.ID == sessionID
+		sessions = append(sessions, session)
+	}
+	if err = rows.Err(); err != nil {
+		respondError(w, fmt.Errorf("could not iterate over sessions: %v", err))
+		return
+	}
+
+	respondJSON(w, sessions, http.StatusOK)
+}
+
+func deleteSession(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	authUserID := ctx.Value(keyAuthUserID).(string)
+	sessionID := strings.ToLower(chi.URLParam(r, "session_id"))
+	if !rxUUID.MatchString(sessionID) {
+		http.Error(w,
+			http.StatusText(http.StatusNotFound),
+			http.StatusNotFound)
+		return
+	}
+
+	var exists bool
+	if err := db.QueryRowContext(ctx, `SELECT EXISTS (
+		SELECT 1 FROM sessions WHERE id = $1::UUID AND user_id = $2
+	)`, sessionID, authUserID).Scan(&exists); err != nil {
+		respondError(w, fmt.Errorf("could not check session existence: %v", err))
+		return
+	}
+
+	if !exists {
+		http.Error(w,
+			http.StatusText(http.StatusNotFound),
+			http.StatusNotFound)
+		return
+	}
+
+	if err := revokeSession(ctx, db, sessionID); err != nil {
+		respondError(w, fmt.Errorf("could not revoke session: %v", err))
+		return
+	}
+
+	recordSecurityEvent(r, authUserID, eventSessionRevoked, outcomeSuccess)
+
+	if sessionID == ctx.Value(keySessionID) {
+		clearAuthCookies(w)
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// deleteSessions logs out everywhere, including the current session.
+func deleteSessions(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	authUserID := ctx.Value(keyAuthUserID).(string)
+
+	if err := revokeUserSessions(ctx, db, authUserID, ""); err != nil {
+		respondError(w, fmt.Errorf("could not revoke sessions: %v", err))
+		return
+	}
+
+	recordSecurityEvent(r, authUserID, eventSessionsRevoked, outcomeSuccess)
+
+	clearAuthCookies(w)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -32,7 +32,7 @@ export function followable(button, username) {
     button.addEventListener('click', () => {
         button.disabled = true
         http.post(`/api/users/${username}/toggle_follow`).then(payload => {
-            button.textContent = followMsg(payload.followingOfMine)
+            button.textContent = followMsg(payload.followingOfMine, payload.followRequested)
             if (followersEl !== null) {
                 followersEl.textContent = followersMsg(payload.followersCount)
             }
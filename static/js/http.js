@@ -22,27 +22,87 @@ export async function handleResponse(res) {
     return payload
 }
 
+/**
+ * Reads the CSRF token the server set in a cookie,
+ * to send it back in a header on state-changing requests.
+ */
+function csrfToken() {
+    const match = /(?:^|;\s*)csrf_token=([^;]*)/.exec(document.cookie)
+    return match === null ? '' : decodeURIComponent(match[1])
+}
+
+/**
+ * @type {Promise<void>}
+ */
+let refreshing = null
+
+/**
+ * Exchanges the refresh token cookie for a new access token.
+ * Concurrent calls share the same request
+ * so the refresh token gets rotated only once.
+ */
+function refreshToken() {
+    if (refreshing === null) {
+        refreshing = fetch('/api/token/refresh', {
+            method: 'POST',
+            credentials: 'include',
+            headers: { 'X-CSRF-Token': csrfToken() },
+        }).then(handleResponse).then(payload => {
+            localStorage.setItem('expires_at', payload.refreshTokenExpiresAt)
+            localStorage.setItem('auth_user', JSON.stringify(payload.user))
+        }).finally(() => {
+            refreshing = null
+        })
+    }
+    return refreshing
+}
+
+/**
+ * Does a fetch and, if unauthorized while logged in,
+ * refreshes the access token and tries once more.
+ *
+ * @param {string} url
+ * @param {RequestInit} options
+ */
+function fetchWithRefresh(url, options) {
+    const doFetch = () => {
+        // The token could have changed after a refresh.
+        if (options.method !== undefined && options.method !== 'GET') {
+            options.headers = Object.assign({}, options.headers, { 'X-CSRF-Token': csrfToken() })
+        }
+        return fetch(url, options)
+    }
+    return doFetch().then(res => {
+        if (res.status !== 401 || localStorage.getItem('auth_user') === null) {
+            return res
+        }
+        return refreshToken().then(doFetch, () => res)
+    })
+}
+
 /**
  * Does a GET request.
  *
  * @param {string} url
  */
-const get = url => fetch(url, { credentials: 'include' }).then(handleResponse)
+const get = url => fetchWithRefresh(url, { credentials: 'include' }).then(handleResponse)
 
 /**
- * Does a POST request.
+ * Does a request with a body.
+ * Form data is sent as is; other objects as JSON.
  *
+ * @param {string} method
  * @param {string} url
  * @param {any=} payload
  * @param {{string: string}=} headers
  */
-function post(url, payload, headers) {
+function send(method, url, payload, headers) {
     const options = {
-        method: 'POST',
+        method,
         credentials: 'include',
         headers: {},
     }
-    if (isObject(payload)) {
+    if (isObject(payload) && !(payload instanceof FormData)) {
         options['body'] = JSON.stringify(payload)
         options.headers['Content-Type'] = 'application/json'
     } else if (payload !== undefined) {
@@ -50,11 +110,30 @@ function post(url, payload, headers) {
     }
     Object.assign(options.headers, headers)
     // @ts-ignore
-    return fetch(url, options).then(handleResponse)
+    return fetchWithRefresh(url, options).then(handleResponse)
 }
 
+/**
+ * Does a POST request.
+ *
+ * @param {string} url
+ * @param {any=} payload
+ * @param {{string: string}=} headers
+ */
+const post = (url, payload, headers) => send('POST', url, payload, headers)
+
+/**
+ * Does a PUT request.
+ *
+ * @param {string} url
+ * @param {any=} payload
+ * @param {{string: string}=} headers
+ */
+const put = (url, payload, headers) => send('PUT', url, payload, headers)
+
 export default {
     handleResponse,
     get,
     post,
+    put,
 }
@@ -42,6 +42,10 @@ const router = routes => pathname => {
  */
 const route = router([
     ['/', authenticated ? genPage('feed') : genPage('welcome')],
+    ['/login/callback', genPage('login-callback')],
+    [/^\/oidc\/([^\/]+)\/callback$/, genPage('login-callback')],
+    [/^\/(verify_email|confirm_email_change|cancel_email_change)$/, genPage('email-link')],
+    ['/reset_password', genPage('reset-password')],
     ['/search', genPage('search')],
     ['/notifications', genPage('notifications')],
     [/^\/users\/([^\/]+)$/, genPage('user')],
@@ -0,0 +1,38 @@
+import http from '../http.js'
+
+const template = document.createElement('template')
+template.innerHTML = `
+<div class="container">
+    <h1>Please wait...</h1>
+    <a href="/" hidden>Continue</a>
+</div>
+`
+
+const doneMessages = {
+    verify_email: 'Email verified',
+    confirm_email_change: 'Email changed',
+    cancel_email_change: 'Email change canceled',
+}
+
+/**
+ * Submits the token of a link sent by email.
+ *
+ * @param {string} action
+ */
+export default function (action) {
+    const page = /** @type {DocumentFragment} */ (template.content.cloneNode(true))
+    const heading = page.querySelector('h1')
+    const link = page.querySelector('a')
+    const token = new URLSearchParams(location.search).get('token')
+
+    http.post('/api/' + action, { token }).then(() => {
+        heading.textContent = doneMessages[action]
+    }).catch(err => {
+        console.error(err)
+        heading.textContent = 'email' in err ? err['email'] : err.message
+    }).finally(() => {
+        link.hidden = false
+    })
+
+    return page
+}
@@ -0,0 +1,77 @@
+import http from '../http.js'
+
+const template = document.createElement('template')
+template.innerHTML = `
+<div class="container">
+    <h1>Logging in...</h1>
+    <form id="totp" hidden>
+        <input type="text" placeholder="Authentication or recovery code" autocomplete="one-time-code" required>
+        <button type="submit">Verify</button>
+    </form>
+</div>
+`
+
+/**
+ * @param {{user: any, refreshTokenExpiresAt: string}} payload
+ */
+function saveLogin(payload) {
+    localStorage.setItem('expires_at', payload.refreshTokenExpiresAt)
+    localStorage.setItem('auth_user', JSON.stringify(payload.user))
+    location.replace('/')
+}
+
+/**
+ * Exchanges the query string of a magic link
+ * or of an identity provider redirect for the auth tokens.
+ *
+ * @param {string=} provider
+ */
+export default function (provider) {
+    const page = /** @type {DocumentFragment} */ (template.content.cloneNode(true))
+    const heading = page.querySelector('h1')
+    const totpForm = /** @type {HTMLFormElement} */ (page.getElementById('totp'))
+    const totpInput = totpForm.querySelector('input')
+    const totpButton = totpForm.querySelector('button')
+    const url = provider === undefined
+        ? '/api/login/callback'
+        : `/api/oidc/${encodeURIComponent(provider)}/callback`
+
+    http.get(url + location.search).then(payload => {
+        if (!payload.totpRequired) {
+            saveLogin(payload)
+            return
+        }
+
+        heading.textContent = 'Two-factor authentication'
+        totpForm.hidden = false
+        totpInput.focus()
+        totpForm.addEventListener('submit', ev => {
+            ev.preventDefault()
+            totpInput.disabled = true
+            totpButton.disabled = true
+            http.post('/api/login/totp', {
+                ticket: payload.ticket,
+                code: totpInput.value.trim(),
+            }).then(saveLogin).catch(err => {
+                console.error(err)
+                if ('code' in err) {
+                    totpInput.setCustomValidity(err['code'])
+                    totpInput.reportValidity()
+                } else {
+                    alert(err.message)
+                }
+                totpInput.disabled = false
+                totpButton.disabled = false
+                totpInput.focus()
+            })
+        })
+        totpInput.addEventListener('input', () => {
+            totpInput.setCustomValidity('')
+        })
+    }).catch(err => {
+        console.error(err)
+        heading.textContent = err.message
+    })
+
+    return page
+}
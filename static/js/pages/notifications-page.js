@@ -21,6 +21,14 @@ function createNotificationLink(notification) {
             action = 'followed you'
             a.href = '/users/' + notification.actorUsername
             break
+        case 'follow_request':
+            action = 'asked to follow you'
+            a.href = '/users/' + notification.actorUsername
+            break
+        case 'follow_request_approved':
+            action = 'approved your follow request'
+            a.href = '/users/' + notification.actorUsername
+            break
         case 'post_mention':
             action = 'mentioned you in a post'
             a.href = '/posts/' + notification.objectId
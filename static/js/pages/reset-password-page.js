@@ -0,0 +1,51 @@
+import http from '../http.js'
+
+const template = document.createElement('template')
+template.innerHTML = `
+<div class="container">
+    <h1>Reset password</h1>
+    <form id="reset-password">
+        <input type="password" placeholder="New password" autocomplete="new-password" autofocus required>
+        <button type="submit">Reset</button>
+    </form>
+    <p id="password-reset" hidden>Password changed. <a href="/">Login</a> with it.</p>
+</div>
+`
+
+export default function () {
+    const page = /** @type {DocumentFragment} */ (template.content.cloneNode(true))
+    const resetForm = /** @type {HTMLFormElement} */ (page.getElementById('reset-password'))
+    const passwordInput = resetForm.querySelector('input')
+    const resetButton = resetForm.querySelector('button')
+    const passwordReset = /** @type {HTMLParagraphElement} */ (page.getElementById('password-reset'))
+    const token = new URLSearchParams(location.search).get('token')
+
+    resetForm.addEventListener('submit', ev => {
+        ev.preventDefault()
+        const password = passwordInput.value
+
+        passwordInput.disabled = true
+        resetButton.disabled = true
+
+        http.post('/api/reset_password', { token, password }).then(() => {
+            resetForm.hidden = true
+            passwordReset.hidden = false
+        }).catch(err => {
+            console.error(err)
+            if ('password' in err) {
+                passwordInput.setCustomValidity(err['password'])
+            } else {
+                alert(err.message)
+            }
+            passwordInput.disabled = false
+            resetButton.disabled = false
+            passwordInput.focus()
+        })
+    })
+
+    passwordInput.addEventListener('input', () => {
+        passwordInput.setCustomValidity('')
+    })
+
+    return page
+}
@@ -29,7 +29,7 @@ function createUserArticle(user) {
         </div>
         ${authenticated ? `
             <div>
-                <button class="follow">${followMsg(user.followingOfMine)}</button>
+                <button class="follow">${followMsg(user.followingOfMine, user.followRequested)}</button>
             </div>
         ` : ''}
     `
@@ -53,34 +53,61 @@ export default function (username) {
         profileDiv.innerHTML = `
             <div class="container">
                 <div>
-                    <figure class="avatar big" data-initial="${user.username[0]}"></figure>
-                    <h1>${user.username}</h1>
+                    ${user.avatarUrl !== null
+                        ? `<img class="avatar big" src="${user.avatarUrl}" alt="${user.username}'s avatar">`
+                        : `<figure class="avatar big" data-initial="${user.username[0]}"></figure>`}
+                    <h1>${user.displayName !== null ? escapeHTML(user.displayName) : user.username}</h1>
+                    ${user.displayName !== null ? `<span>@${user.username}</span>` : ''}
                 </div>
+                ${user.bio !== null ? `<p class="bio">${linkify(escapeHTML(user.bio))}</p>` : ''}
                 <div class="user-stats">
                     <a href="#!" class="followers-count">${followersMsg(user.followersCount)}</a>
                     <a href="#!">${user.followingCount} following</a>
                 </div>
                 <div>
                     ${user.me ? `
-                        <button>Edit avatar</button>
-                        <input type="file" accept="image/jpg,image/png" hidden>
+                        <button id="edit-avatar">Edit avatar</button>
+                        <input type="file" accept="image/jpeg,image/png,image/gif" hidden>
                         <button id="logout">Logout</button>
                     ` : authenticated ? `
-                        <button id="follow" title="${followMsg(user.followingOfMine)}">${followMsg(user.followingOfMine)}</button>
+                        <button id="follow" title="${followMsg(user.followingOfMine, user.followRequested)}">${followMsg(user.followingOfMine, user.followRequested)}</button>
                     ` : ''}
                 </div>
             </div>
         `
 
         if (user.me) {
+            const editAvatarButton = /** @type {HTMLButtonElement} */ (profileDiv.querySelector('#edit-avatar'))
+            const avatarInput = /** @type {HTMLInputElement} */ (profileDiv.querySelector('input[type=file]'))
+            editAvatarButton.addEventListener('click', () => {
+                avatarInput.click()
+            })
+            avatarInput.addEventListener('change', () => {
+                if (avatarInput.files.length === 0) return
+                const data = new FormData()
+                data.append('avatar', avatarInput.files[0])
+                editAvatarButton.disabled = true
+                http.put('/api/auth_user/avatar', data).then(payload => {
+                    const img = document.createElement('img')
+                    img.className = 'avatar big'
+                    img.src = payload.avatarUrl
+                    img.alt = `${user.username}'s avatar`
+                    profileDiv.querySelector('.avatar.big').replaceWith(img)
+                }).catch(err => {
+                    console.error(err)
+                    alert('avatar' in err ? err['avatar'] : err.message)
+                }).finally(() => {
+                    editAvatarButton.disabled = false
+                    avatarInput.value = ''
+                })
+            })
+
             profileDiv.querySelector('#logout').addEventListener('click', () => {
-                localStorage.clear()
-                // Clear cookies
-                document.cookie.split(';').forEach(c => {
-                    document.cookie = c.trim()
-                        .replace(/=.*/, `=;expires=${new Date().toUTCString()};path=/`)
+                // Cookies are http only; the server revokes and clears them.
+                http.post('/api/logout').catch(console.error).finally(() => {
+                    localStorage.clear()
+                    location.assign('/')
                 })
-                location.assign('/')
             })
         } else if (authenticated) {
             followable(profileDiv.querySelector('#follow'), user.username)
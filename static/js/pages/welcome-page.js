@@ -8,6 +8,8 @@ template.innerHTML = `
         <input type="email" placeholder="Email" value="john@example.dev" autocomplete="email" autofocus required>
         <button type="submit">Login</button>
     </form>
+    <p id="login-sent" hidden>Check your inbox. We sent you a magic link to login.</p>
+    <div id="providers"></div>
 </div>
 `
 
@@ -16,6 +18,8 @@ export default function () {
     const loginForm = /** @type {HTMLFormElement} */ (page.getElementById('login'))
     const loginInput = loginForm.querySelector('input')
     const loginButton = loginForm.querySelector('button')
+    const loginSent = /** @type {HTMLParagraphElement} */ (page.getElementById('login-sent'))
+    const providersDiv = /** @type {HTMLDivElement} */ (page.getElementById('providers'))
 
     loginForm.addEventListener('submit', ev => {
         ev.preventDefault()
@@ -29,10 +33,9 @@ export default function () {
         loginInput.disabled = true
         loginButton.disabled = true
 
-        http.post('/api/login', { email }).then(payload => {
-            localStorage.setItem('expires_at', payload.expiresAt)
-            localStorage.setItem('auth_user', JSON.stringify(payload.user))
-            location.reload()
+        http.post('/api/login', { email }).then(() => {
+            loginForm.hidden = true
+            loginSent.hidden = false
         }).catch(err => {
             console.error(err)
             if ('email' in err) {
@@ -46,6 +49,17 @@ export default function () {
         })
     })
 
+    http.get('/api/oidc_providers').then(providers => {
+        for (const provider of providers) {
+            const button = document.createElement('button')
+            button.textContent = 'Sign in with ' + provider
+            button.addEventListener('click', () => {
+                location.assign(`/api/oidc/${encodeURIComponent(provider)}/login`)
+            })
+            providersDiv.appendChild(button)
+        }
+    }).catch(console.error)
+
     loginInput.addEventListener('input', () => {
         loginInput.setCustomValidity('')
     })
@@ -14,9 +14,10 @@ export const commentsMsg = x => `${x} comment${x !== 1 ? 's' : ''}`
 export const followersMsg = x => `${x} follower${x !== 1 ? 's' : ''}`
 
 /**
- * @param {boolean} x
+ * @param {boolean} following
+ * @param {boolean} requested
  */
-export const followMsg = x => x ? 'Following' : 'Follow'
+export const followMsg = (following, requested) => following ? 'Following' : requested ? 'Requested' : 'Follow'
 
 export const isObject = x => typeof x === 'object' && x !== null
 
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Storage saves public files, like avatars, and tells the URL they're served at.
+// FileStorage keeps them on the local disk, so instances behind a load balancer
+// need a shared volume or an implementation backed by object storage.
+type Storage interface {
+	Put(ctx context.Context, name string, data []byte, contentType string) error
+	Delete(ctx context.Context, name string) error
+	URL(name string) string
+}
+
+// FileStorage saves files in a directory of the local filesystem
+// and serves them under BaseURL.
+type FileStorage struct {
+	Dir     string
+	BaseURL string
+}
+
+var storage Storage
+
+// Put writes the file, replacing it if it exists.
+func (s *FileStorage) Put(ctx context.Context, name string, data []byte, contentType string) error {
+	if err := os.MkdirAll(s.Dir, 0755); err != nil {
+		return err
+	}
+
+	// Written aside and renamed so nobody is served half a file.
+	p := filepath.Join(s.Dir, filepath.Base(name))
+	tmp := p + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, p)
+}
+
+// Delete the file. Deleting a nonexistent file is not an error.
+func (s *FileStorage) Delete(ctx context.Context, name string) error {
+	err := os.Remove(filepath.Join(s.Dir, filepath.Base(name)))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// URL the file is served at.
+func (s *FileStorage) URL(name string) string {
+	return s.BaseURL + name
+}
+
+// ServeHTTP serves the file named after the last path segment.
+// Names are never reused, so files can be cached forever.
+func (s *FileStorage) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	name := path.Base(r.URL.Path)
+	if name == "/" || name == "." || strings.HasSuffix(name, ".tmp") {
+		http.NotFound(w, r)
+		return
+	}
+
+	f, err := os.Open(filepath.Join(s.Dir, name))
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil || fi.IsDir() {
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	http.ServeContent(w, r, name, fi.ModTime(), f)
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+)
+
+const suggestedUsersLimit = 20
+
+// getSuggestedUsers ranks users to follow.
+// Candidates come from the follow graph around the auth user,
+// plus the most followed and the latest posters so new users get some too,
+// except the ones already followed or asked to follow.
+// Each one scores 3 for every followee of mine following them,
+// 2 for every follower of mine following them, 2 if they follow me,
+// 1 if they posted in the last week, and the log of their followers count.
+func getSuggestedUsers(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	authUserID := ctx.Value(keyAuthUserID).(string)
+
+	rows, err := db.QueryContext(ctx, fmt.Sprintf(`
+		WITH
+			my_followees AS (SELECT following_id AS user_id FROM follows WHERE follower_id = $1),
+			my_followers AS (SELECT follower_id AS user_id FROM follows WHERE following_id = $1),
+			friends_of_friends AS (
+				SELECT following_id AS user_id, count(*) AS n FROM follows
+				WHERE follower_id IN (SELECT user_id FROM my_followees)
+				GROUP BY following_id
+			),
+			mutual_followers AS (
+				SELECT following_id AS user_id, count(*) AS n FROM follows
+				WHERE follower_id IN (SELECT user_id FROM my_followers)
+				GROUP BY following_id
+			),
+			active AS (
+				SELECT DISTINCT user_id FROM posts
+				WHERE created_at > now() - INTERVAL '7 days'
+			),
+			candidates AS (
+				SELECT user_id FROM friends_of_friends
+				UNION SELECT user_id FROM mutual_followers
+				UNION SELECT user_id FROM my_followers
+				UNION (SELECT id FROM users ORDER BY followers_count DESC LIMIT 100)
+				UNION (SELECT user_id FROM posts ORDER BY created_at DESC LIMIT 100)
+			)
+		SELECT
+			users.username,
+			users.avatar_url,
+			users.display_name,
+			users.bio,
+			users.private,
+			users.followers_count,
+			users.following_count,
+			users.created_at,
+			my_followers.user_id IS NOT NULL AS follower_of_mine
+		FROM users
+		LEFT JOIN friends_of_friends ON friends_of_friends.user_id = users.id
+		LEFT JOIN mutual_followers ON mutual_followers.user_id = users.id
+		LEFT JOIN my_followers ON my_followers.user_id = users.id
+		LEFT JOIN active ON active.user_id = users.id
+		WHERE users.id IN (SELECT user_id FROM candidates)
+			AND users.id != $1
+			AND users.id NOT IN (SELECT user_id FROM my_followees)
+			AND users.id NOT IN (SELECT following_id FROM follow_requests WHERE follower_id = $1)
+			AND NOT `+sqlUserSuspended+`
+			AND `+sqlNotBlocked("$1", "users.id")+`
+		ORDER BY
+			COALESCE(friends_of_friends.n, 0)::FLOAT * 3
+				+ COALESCE(mutual_followers.n, 0)::FLOAT * 2
+				+ CASE WHEN my_followers.user_id IS NOT NULL THEN 2 ELSE 0 END::FLOAT
+				+ CASE WHEN active.user_id IS NOT NULL THEN 1 ELSE 0 END::FLOAT
+				+ ln(users.followers_count::FLOAT + 1) DESC,
+			users.id
+		LIMIT %d`, suggestedUsersLimit), authUserID)
+	if err != nil {
+		respondError(w, fmt.Errorf("could not query suggested users: %v", err))
+		return
+	}
+	defer rows.Close()
+
+	users := make([]Profile, 0)
+	for rows.Next() {
+		var user Profile
+		if err = rows.Scan(
+			&user.Username,
+			&user.AvatarURL,
+			&user.DisplayName,
+			&user.Bio,
+			&user.Private,
+			&user.FollowersCount,
+			&user.FollowingCount,
+			&user.CreatedAt,
+			&user.FollowerOfMine,
+		); err != nil {
+			respondError(w, fmt.Errorf("could not scan suggested user: %v", err))
+			return
+		}
+
+		users = append(users, user)
+	}
+	if err = rows.Err(); err != nil {
+		respondError(w, fmt.Errorf("could not iterate over suggested users: %v", err))
+		return
+	}
+
+	respondJSON(w, users, http.StatusOK)
+}
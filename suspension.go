@@ -0,0 +1,235 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/cockroachdb/cockroach-go/crdb"
+	"github.com/go-chi/chi"
+)
+
+// SuspendUserInput request body
+type SuspendUserInput struct {
+	Reason string     `json:"reason"`
+	Until  *time.Time `json:"until,omitempty"`
+}
+
+// BanUserInput request body
+type BanUserInput struct {
+	Reason string `json:"reason"`
+}
+
+// Suspension model
+type Suspension struct {
+	Banned bool       `json:"banned"`
+	Reason *string    `json:"reason"`
+	Until  *time.Time `json:"until"`
+}
+
+// sqlUserSuspended is true for users banned or currently suspended.
+const sqlUserSuspended = `(users.banned_at IS NOT NULL OR (users.suspended_at IS NOT NULL AND (users.suspended_until IS NULL OR users.suspended_until > now())))`
+
+// userSuspension returns the ban or current suspension of a user, if any.
+func userSuspension(ctx context.Context, userID string) (*Suspension, error) {
+	var suspension Suspension
+	var suspended bool
+	err := db.QueryRowContext(ctx, `
+		SELECT
+			banned_at IS NOT NULL,
+			`+sqlUserSuspended+`,
+			COALESCE(ban_reason, suspension_reason),
+			suspended_until
+		FROM users WHERE id = $1
+	`, userID).Scan(&suspension.Banned, &suspended, &suspension.Reason, &suspension.Until)
+	if err == sql.ErrNoRows || (err == nil && !suspended) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if suspension.Banned {
+		suspension.Until = nil
+	}
+	return &suspension, nil
+}
+
+// rejectSuspended responds with 403 Forbidden and the suspension
+// if the user is banned or suspended.
+func rejectSuspended(w http.ResponseWriter, r *http.Request, userID string) bool {
+	suspension, err := userSuspension(r.Context(), userID)
+	if err != nil {
+		respondError(w, fmt.Errorf("could not query user suspension: %v", err))
+		return true
+	}
+
+	if suspension == nil {
+		return false
+	}
+
+	respondJSON(w, suspension, http.StatusForbidden)
+	return true
+}
+
+// moderatedUserID returns the ID of the user to moderate.
+// Only users with a lower role can be moderated.
+func moderatedUserID(w http.ResponseWriter, r *http.Request) (string, bool) {
+	ctx := r.Context()
+	authUser := ctx.Value(keyAuthUser).(User)
+	username := chi.URLParam(r, "username")
+
+	var userID, role string
+	if err := db.QueryRowContext(ctx, "SELECT id, role FROM users WHERE username = $1", username).
+		Scan(&userID, &role); err == sql.ErrNoRows {
+		http.Error(w,
+			http.StatusText(http.StatusNotFound),
+			http.StatusNotFound)
+		return "", false
+	} else if err != nil {
+		respondError(w, fmt.Errorf("could not query user to moderate: %v", err))
+		return "", false
+	}
+
+	if hasRole(role, authUser.Role) {
+		http.Error(w,
+			http.StatusText(http.StatusForbidden),
+			http.StatusForbidden)
+		return "", false
+	}
+
+	return userID, true
+}
+
+func suspendUser(w http.ResponseWriter, r *http.Request) {
+	var input SuspendUserInput
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer r.Body.Close()
+
+	reason := strings.TrimSpace(input.Reason)
+	errs := map[string]string{}
+	if reason == "" || len(reason) > 480 {
+		errs["reason"] = "Reason must be between 1 and 480 characters long"
+	}
+	if input.Until != nil && input.Until.Before(time.Now()) {
+		errs["until"] = "Suspension must end in the future"
+	}
+	if len(errs) != 0 {
+		respondJSON(w, errs, http.StatusUnprocessableEntity)
+		return
+	}
+
+	userID, ok := moderatedUserID(w, r)
+	if !ok {
+		return
+	}
+
+	// Sessions are kept so the user is back once the suspension is over.
+	if _, err := db.ExecContext(r.Context(), `
+		UPDATE users SET suspended_at = now(), suspended_until = $1, suspension_reason = $2
+		WHERE id = $3
+		RETURNING NOTHING
+	`, input.Until, reason, userID); err != nil {
+		respondError(w, fmt.Errorf("could not suspend user: %v", err))
+		return
+	}
+
+	recordSecurityEvent(r, userID, eventSuspended, outcomeSuccess)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func unsuspendUser(w http.ResponseWriter, r *http.Request) {
+	userID, ok := moderatedUserID(w, r)
+	if !ok {
+		return
+	}
+
+	if _, err := db.ExecContext(r.Context(), `
+		UPDATE users SET suspended_at = NULL, suspended_until = NULL, suspension_reason = NULL
+		WHERE id = $1
+		RETURNING NOTHING
+	`, userID); err != nil {
+		respondError(w, fmt.Errorf("could not unsuspend user: %v", err))
+		return
+	}
+
+	recordSecurityEvent(r, userID, eventUnsuspended, outcomeSuccess)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func banUser(w http.ResponseWriter, r *http.Request) {
+	var input BanUserInput
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer r.Body.Close()
+
+	reason := strings.TrimSpace(input.Reason)
+	if reason == "" || len(reason) > 480 {
+		respondJSON(w, map[string]string{
+			"reason": "Reason must be between 1 and 480 characters long",
+		}, http.StatusUnprocessableEntity)
+		return
+	}
+
+	userID, ok := moderatedUserID(w, r)
+	if !ok {
+		return
+	}
+
+	ctx := r.Context()
+	if err := crdb.ExecuteTx(ctx, db, nil, func(tx *sql.Tx) error {
+		if _, err := tx.Exec(`
+			UPDATE users SET banned_at = now(), ban_reason = $1
+			WHERE id = $2
+			RETURNING NOTHING
+		`, reason, userID); err != nil {
+			return err
+		}
+
+		if _, err := tx.Exec(`
+			DELETE FROM personal_tokens WHERE user_id = $1
+			RETURNING NOTHING
+		`, userID); err != nil {
+			return err
+		}
+
+		return revokeUserSessions(ctx, tx, userID, "")
+	}); err != nil {
+		respondError(w, fmt.Errorf("could not ban user: %v", err))
+		return
+	}
+
+	recordSecurityEvent(r, userID, eventBanned, outcomeSuccess)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func unbanUser(w http.ResponseWriter, r *http.Request) {
+	userID, ok := moderatedUserID(w, r)
+	if !ok {
+		return
+	}
+
+	if _, err := db.ExecContext(r.Context(), `
+		UPDATE users SET banned_at = NULL, ban_reason = NULL
+		WHERE id = $1
+		RETURNING NOTHING
+	`, userID); err != nil {
+		respondError(w, fmt.Errorf("could not unban user: %v", err))
+		return
+	}
+
+	recordSecurityEvent(r, userID, eventUnbanned, outcomeSuccess)
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ThrottleEntry tracks the attempts of a key.
+type ThrottleEntry struct {
+	Attempts     int
+	BlockedUntil time.Time
+}
+
+// ThrottleStore persists throttle entries.
+// MemoryThrottleStore works for a single instance;
+// a shared store can be plugged in when running many.
+// Incr must be atomic, or concurrent attempts could go uncounted.
+type ThrottleStore interface {
+	// Incr counts an attempt of key unless it's blocked.
+	// The attempt blocks key for delay(attempts) and keeps it for at least ttl.
+	// It returns the entry and whether the attempt was counted.
+	Incr(key string, delay func(attempts int) time.Duration, ttl time.Duration) (ThrottleEntry, bool, error)
+	Delete(key string) error
+}
+
+// MemoryThrottleStore keeps entries in memory.
+type MemoryThrottleStore struct {
+	mu      sync.Mutex
+	entries expiringMap
+}
+
+// Throttler blocks keys after too many attempts,
+// doubling the delay with each attempt past the free ones, up to a lockout window.
+// Attempts are forgotten after a quiet period.
+type Throttler struct {
+	Store        ThrottleStore
+	FreeAttempts int
+	BaseDelay    time.Duration
+	MaxDelay     time.Duration
+	ResetAfter   time.Duration
+}
+
+var throttleStore ThrottleStore = NewMemoryThrottleStore()
+
+var (
+	// loginThrottler counts password and TOTP attempts,
+	// forgiven when right, and every magic link or password reset email sent.
+	loginThrottler = &Throttler{
+		Store:        throttleStore,
+		FreeAttempts: 5,
+		BaseDelay:    time.Second * 30,
+		MaxDelay:     time.Hour,
+		ResetAfter:   time.Hour,
+	}
+	// ipLoginThrottler counts the logins of an IP, right or wrong.
+	// It's never forgiven, or owning an account would be enough to keep guessing others',
+	// so it allows more attempts for people sharing an IP.
+	ipLoginThrottler = &Throttler{
+		Store:        throttleStore,
+		FreeAttempts: 30,
+		BaseDelay:    time.Second * 30,
+		MaxDelay:     time.Hour,
+		ResetAfter:   time.Hour,
+	}
+	// signupThrottler counts every signup.
+	signupThrottler = &Throttler{
+		Store:        throttleStore,
+		FreeAttempts: 5,
+		BaseDelay:    time.Minute,
+		MaxDelay:     time.Hour * 24,
+		ResetAfter:   time.Hour * 24,
+	}
+)
+
+// NewMemoryThrottleStore creates an empty MemoryThrottleStore.
+func NewMemoryThrottleStore() *MemoryThrottleStore {
+	return &MemoryThrottleStore{}
+}
+
+// Incr counts an attempt of key unless it's blocked.
+func (s *MemoryThrottleStore) Incr(key string, delay func(attempts int) time.Duration, ttl time.Duration) (ThrottleEntry, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	var entry ThrottleEntry
+	if v, ok := s.entries.get(key, now); ok {
+		entry = v.(ThrottleEntry)
+	}
+
+	if now.Before(entry.BlockedUntil) {
+		return entry, false, nil
+	}
+
+	entry.Attempts++
+	if d := delay(entry.Attempts); d > 0 {
+		entry.BlockedUntil = now.Add(d)
+	}
+	if d := entry.BlockedUntil.Sub(now); d > ttl {
+		ttl = d
+	}
+
+	s.entries.set(key, entry, now.Add(ttl), now)
+	return entry, true, nil
+}
+
+// Delete the entry of key.
+func (s *MemoryThrottleStore) Delete(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.entries.delete(key)
+	return nil
+}
+
+// Attempt counts an attempt for each key not blocked,
+// and returns how long until all the keys are allowed again.
+// Attempts are counted before knowing whether they are right,
+// so a burst of them can't slip through before the first one fails.
+func (t *Throttler) Attempt(keys ...string) (time.Duration, error) {
+	var wait time.Duration
+	for _, key := range keys {
+		entry, counted, err := t.Store.Incr(key, t.delay, t.ResetAfter)
+		if err != nil {
+			return 0, err
+		}
+
+		if d := time.Until(entry.BlockedUntil); !counted && d > wait {
+			wait = d
+		}
+	}
+	return wait, nil
+}
+
+// delay after the given number of attempts.
+func (t *Throttler) delay(attempts int) time.Duration {
+	over := attempts - t.FreeAttempts
+	if over <= 0 {
+		return 0
+	}
+	if over >= 32 {
+		return t.MaxDelay
+	}
+	return time.Duration(math.Min(
+		float64(t.BaseDelay)*float64(uint(1)<<uint(over-1)),
+		float64(t.MaxDelay)))
+}
+
+// Reset forgets the attempts of each key.
+func (t *Throttler) Reset(keys ...string) error {
+	for _, key := range keys {
+		if err := t.Store.Delete(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// throttled counts an attempt for the keys
+// and responds with 429 Too Many Requests if any of them is blocked.
+// The response is the same whatever the keys,
+// so it doesn't tell whether an email is registered.
+func throttled(w http.ResponseWriter, t *Throttler, keys ...string) bool {
+	wait, err := t.Attempt(keys...)
+	if err != nil {
+		respondError(w, fmt.Errorf("could not check throttle: %v", err))
+		return true
+	}
+
+	if wait <= 0 {
+		return false
+	}
+
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	http.Error(w, "Too many attempts, try again later", http.StatusTooManyRequests)
+	return true
+}
+
+func ipThrottleKey(prefix string, r *http.Request) string {
+	return prefix + ":ip:" + clientIP(r)
+}
+
+func emailThrottleKey(prefix, email string) string {
+	return prefix + ":email:" + strings.ToLower(email)
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/cockroachdb/cockroach-go/crdb"
+)
+
+// RefreshTokenInput request body
+type RefreshTokenInput struct {
+	RefreshToken string `json:"refreshToken"`
+}
+
+// execer is either *sql.DB or *sql.Tx.
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+}
+
+var errRefreshTokenReused = errors.New("refresh token reused")
+
+// refreshTokenReuseGrace is how long a rotated refresh token still works.
+// Tabs sharing the cookie may refresh at the same time,
+// and the one that loses the race shouldn't look like a leak.
+const refreshTokenReuseGrace = time.Second * 10
+
+// insertRefreshToken generates and stores a new refresh token for the session.
+func insertRefreshToken(ctx context.Context, e execer, userID, sessionID string) (string, time.Time, error) {
+	token, tokenHash, err := genToken()
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	expiresAt := time.Now().Add(refreshTokenLifespan)
+	if _, err := e.ExecContext(ctx, `
+		INSERT INTO refresh_tokens (token_hash, session_id, user_id, expires_at) VALUES ($1, $2, $3, $4)
+		RETURNING NOTHING
+	`, tokenHash, sessionID, userID, expiresAt); err != nil {
+		return "", time.Time{}, err
+	}
+
+	return token, expiresAt, nil
+}
+
+func refreshToken(w http.ResponseWriter, r *http.Request) {
+	var token string
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		var input RefreshTokenInput
+		if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		defer r.Body.Close()
+
+		token = input.RefreshToken
+	} else if c, err := r.Cookie("refresh_token"); err == nil {
+		token = c.Value
+	}
+
+	if token == "" {
+		http.Error(w,
+			http.StatusText(http.StatusUnauthorized),
+			http.StatusUnauthorized)
+		return
+	}
+
+	ctx := r.Context()
+	var user User
+	var sessionID string
+	var newToken string
+	var newTokenExpiresAt time.Time
+	if err := crdb.ExecuteTx(ctx, db, nil, func(tx *sql.Tx) error {
+		var usedAt *time.Time
+		var expiresAt time.Time
+		if err := tx.QueryRow(`
+			SELECT session_id, user_id, used_at, expires_at
+			FROM refresh_tokens
+			WHERE token_hash = $1
+		`, hashToken(token)).Scan(&sessionID, &user.ID, &usedAt, &expiresAt); err != nil {
+			return err
+		}
+
+		// A token that was already rotated a while ago is being used again,
+		// so it may have leaked.
+		if usedAt != nil && time.Since(*usedAt) > refreshTokenReuseGrace {
+			return errRefreshTokenReused
+		}
+
+		if expiresAt.Before(time.Now()) {
+			return sql.ErrNoRows
+		}
+
+		// Within the grace period the first use stands.
+		if usedAt == nil {
+			if _, err := tx.Exec(`
+				UPDATE refresh_tokens SET used_at = now()
+				WHERE token_hash = $1
+				RETURNING NOTHING
+			`, hashToken(token)); err != nil {
+				return err
+			}
+		}
+
+		var err error
+		newToken, newTokenExpiresAt, err = insertRefreshToken(ctx, tx, user.ID, sessionID)
+		if err != nil {
+			return err
+		}
+
+		if _, err := tx.Exec(`
+			UPDATE sessions SET expires_at = $1, last_seen_at = now(), ip = $2
+			WHERE id = $3
+			RETURNING NOTHING
+		`, newTokenExpiresAt, clientIP(r), sessionID); err != nil {
+			return err
+		}
+
+		return tx.QueryRow("SELECT username, avatar_url FROM users WHERE id = $1", user.ID).
+			Scan(&user.Username, &user.AvatarURL)
+	}); err == errRefreshTokenReused {
+		// Revoke the whole session; both the legit client
+		// and whoever holds the leaked token must login again.
+		if err := revokeSession(ctx, db, sessionID); err != nil {
+			log.Printf("could not revoke session of reused refresh token: %v\n", err)
+		}
+		recordSecurityEvent(r, user.ID, eventRefreshTokenReused, outcomeFailure)
+		http.Error(w,
+			http.StatusText(http.StatusUnauthorized),
+			http.StatusUnauthorized)
+		return
+	} else if err == sql.ErrNoRows {
+		http.Error(w,
+			http.StatusText(http.StatusUnauthorized),
+			http.StatusUnauthorized)
+		return
+	} else if err != nil {
+		respondError(w, fmt.Errorf("could not refresh token: %v", err))
+		return
+	}
+
+	respondTokens(w, user, sessionID, newToken, newTokenExpiresAt)
+}
@@ -0,0 +1,427 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/cockroachdb/cockroach-go/crdb"
+	"github.com/dgrijalva/jwt-go"
+)
+
+// TOTPInput request body
+type TOTPInput struct {
+	Code string `json:"code"`
+}
+
+// LoginTOTPInput request body
+type LoginTOTPInput struct {
+	Ticket string `json:"ticket"`
+	Code   string `json:"code"`
+}
+
+// TOTPChallengePayload response body.
+// Sent instead of LoginPayload when the user has two-factor authentication;
+// the ticket along with a code or recovery code completes the login.
+type TOTPChallengePayload struct {
+	TOTPRequired bool      `json:"totpRequired"`
+	Ticket       string    `json:"ticket"`
+	ExpiresAt    time.Time `json:"expiresAt"`
+}
+
+// TOTPEnrollmentPayload response body
+type TOTPEnrollmentPayload struct {
+	Secret string `json:"secret"`
+	URI    string `json:"uri"`
+}
+
+// TOTPConfirmationPayload response body
+type TOTPConfirmationPayload struct {
+	RecoveryCodes []string `json:"recoveryCodes"`
+}
+
+const (
+	totpPeriod          = 30
+	totpDigits          = 6
+	totpSkew            = 1 // Steps accepted before and after the current one.
+	totpTicketLifespan  = time.Minute * 5
+	totpTicketType      = "totp"
+	recoveryCodesCount  = 10
+	recoveryCodeCharset = "abcdefghjkmnpqrstuvwxyz23456789"
+)
+
+var base32NoPadding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+var (
+	errInvalidTOTPCode    = errors.New("Invalid code")
+	errTOTPAlreadyEnabled = errors.New("Two-factor authentication already enabled")
+	errTOTPNotEnrolled    = errors.New("Two-factor authentication not enrolled")
+)
+
+// totpCode computes the code for the given time step as of RFC 6238.
+func totpCode(secret []byte, step int64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(step))
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	mod := uint32(1)
+	for i := 0; i < totpDigits; i++ {
+		mod *= 10
+	}
+	return fmt.Sprintf("%0*d", totpDigits, value%mod)
+}
+
+// verifyTOTP returns the time step the code matches, if any,
+// so the caller can reject it next time.
+func verifyTOTP(secret []byte, code string, lastStep int64) (int64, bool) {
+	code = strings.Replace(code, " ", "", -1)
+	current := time.Now().Unix() / totpPeriod
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		if step <= lastStep {
+			continue
+		}
+		if subtle.ConstantTimeCompare([]byte(totpCode(secret, step)), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+func normalizeRecoveryCode(code string) string {
+	code = strings.ToLower(code)
+	code = strings.Replace(code, "-", "", -1)
+	return strings.Replace(code, " ", "", -1)
+}
+
+func genRecoveryCode() (string, error) {
+	b := make([]byte, 10)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	for i := range b {
+		b[i] = recoveryCodeCharset[int(b[i])%len(recoveryCodeCharset)]
+	}
+	return string(b[:5]) + "-" + string(b[5:]), nil
+}
+
+// useTOTPCode verifies either a TOTP code, which can't be used again,
+// or a recovery code, which gets deleted.
+func useTOTPCode(tx *sql.Tx, userID string, secret []byte, lastStep int64, code string) error {
+	if step, ok := verifyTOTP(secret, code, lastStep); ok {
+		_, err := tx.Exec(`
+			UPDATE users SET totp_last_step = $1
+			WHERE id = $2
+			RETURNING NOTHING
+		`, step, userID)
+		return err
+	}
+
+	// Not a TOTP code; maybe a recovery code, which works only once.
+	result, err := tx.Exec(`
+		DELETE FROM recovery_codes
+		WHERE user_id = $1 AND code_hash = $2
+	`, userID, hashToken(normalizeRecoveryCode(code)))
+	if err != nil {
+		return err
+	}
+
+	if n, err := result.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return errInvalidTOTPCode
+	}
+
+	return nil
+}
+
+// respondTOTPChallenge with a short-lived ticket for the second login step.
+func respondTOTPChallenge(w http.ResponseWriter, user User) {
+	expiresAt := time.Now().Add(totpTicketLifespan)
+	ticket, err := keyRing.Sign(Claims{
+		StandardClaims: jwt.StandardClaims{
+			Issuer:    origin,
+			Subject:   user.ID,
+			ExpiresAt: expiresAt.Unix(),
+		},
+		TokenType: totpTicketType,
+	})
+	if err != nil {
+		respondError(w, fmt.Errorf("could not generate TOTP ticket: %v", err))
+		return
+	}
+
+	respondJSON(w, TOTPChallengePayload{true, ticket, expiresAt}, http.StatusOK)
+}
+
+func loginTOTP(w http.ResponseWriter, r *http.Request) {
+	var input LoginTOTPInput
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer r.Body.Close()
+
+	p := jwt.Parser{ValidMethods: keyRing.ValidMethods()}
+	token, err := p.ParseWithClaims(input.Ticket, &Claims{}, keyRing.Keyfunc)
+	if err != nil {
+		http.Error(w, "Invalid or expired ticket", http.StatusUnauthorized)
+		return
+	}
+
+	claims, ok := token.Claims.(*Claims)
+	if !ok || !token.Valid || claims.TokenType != totpTicketType {
+		http.Error(w, "Invalid or expired ticket", http.StatusUnauthorized)
+		return
+	}
+
+	throttleKey := "totp:user:" + claims.Subject
+	if throttled(w, loginThrottler, throttleKey) {
+		return
+	}
+
+	ctx := r.Context()
+	user := User{ID: claims.Subject}
+	if err := crdb.ExecuteTx(ctx, db, nil, func(tx *sql.Tx) error {
+		var secret []byte
+		var lastStep int64
+		if err := tx.QueryRow(`
+			SELECT username, avatar_url, totp_secret, totp_last_step
+			FROM users
+			WHERE id = $1 AND totp_enabled
+		`, user.ID).Scan(&user.Username, &user.AvatarURL, &secret, &lastStep); err != nil {
+			return err
+		}
+
+		return useTOTPCode(tx, user.ID, secret, lastStep, input.Code)
+	}); err == errInvalidTOTPCode {
+		recordSecurityEvent(r, user.ID, eventLogin, outcomeFailure)
+		respondJSON(w, map[string]string{
+			"code": errInvalidTOTPCode.Error(),
+		}, http.StatusUnprocessableEntity)
+		return
+	} else if err == sql.ErrNoRows {
+		http.Error(w, "Invalid or expired ticket", http.StatusUnauthorized)
+		return
+	} else if err != nil {
+		respondError(w, fmt.Errorf("could not verify TOTP code: %v", err))
+		return
+	}
+
+	if err := loginThrottler.Reset(throttleKey); err != nil {
+		log.Printf("could not reset TOTP throttle: %v\n", err)
+	}
+
+	startSession(w, r, user)
+}
+
+func enrollTOTP(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	authUser := ctx.Value(keyAuthUser).(User)
+
+	secret := make([]byte, 20)
+	if _, err := rand.Read(secret); err != nil {
+		respondError(w, fmt.Errorf("could not generate TOTP secret: %v", err))
+		return
+	}
+
+	// Enrolling again before confirming just replaces the secret.
+	result, err := db.ExecContext(ctx, `
+		UPDATE users SET totp_secret = $1, totp_last_step = 0
+		WHERE id = $2 AND NOT totp_enabled
+	`, secret, authUser.ID)
+	if err != nil {
+		respondError(w, fmt.Errorf("could not update TOTP secret: %v", err))
+		return
+	}
+
+	if n, err := result.RowsAffected(); err != nil {
+		respondError(w, fmt.Errorf("could not update TOTP secret: %v", err))
+		return
+	} else if n == 0 {
+		http.Error(w, errTOTPAlreadyEnabled.Error(), http.StatusConflict)
+		return
+	}
+
+	encodedSecret := base32NoPadding.EncodeToString(secret)
+	q := url.Values{}
+	q.Set("secret", encodedSecret)
+	q.Set("issuer", "Nakama")
+	q.Set("digits", fmt.Sprint(totpDigits))
+	q.Set("period", fmt.Sprint(totpPeriod))
+	uri := "otpauth://totp/" + url.PathEscape("Nakama:"+authUser.Username) + "?" + q.Encode()
+
+	respondJSON(w, TOTPEnrollmentPayload{encodedSecret, uri}, http.StatusOK)
+}
+
+func confirmTOTP(w http.ResponseWriter, r *http.Request) {
+	var input TOTPInput
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer r.Body.Close()
+
+	ctx := r.Context()
+	authUserID := ctx.Value(keyAuthUserID).(string)
+
+	recoveryCodes := make([]string, recoveryCodesCount)
+	for i := range recoveryCodes {
+		code, err := genRecoveryCode()
+		if err != nil {
+			respondError(w, fmt.Errorf("could not generate recovery code: %v", err))
+			return
+		}
+		recoveryCodes[i] = code
+	}
+
+	if err := crdb.ExecuteTx(ctx, db, nil, func(tx *sql.Tx) error {
+		var secret []byte
+		var enabled bool
+		var lastStep int64
+		if err := tx.QueryRow(`
+			SELECT totp_secret, totp_enabled, totp_last_step
+			FROM users
+			WHERE id = $1
+		`, authUserID).Scan(&secret, &enabled, &lastStep); err != nil {
+			return err
+		}
+
+		if enabled {
+			return errTOTPAlreadyEnabled
+		}
+
+		if secret == nil {
+			return errTOTPNotEnrolled
+		}
+
+		step, ok := verifyTOTP(secret, input.Code, lastStep)
+		if !ok {
+			return errInvalidTOTPCode
+		}
+
+		if _, err := tx.Exec(`
+			UPDATE users SET totp_enabled = true, totp_last_step = $1
+			WHERE id = $2
+			RETURNING NOTHING
+		`, step, authUserID); err != nil {
+			return err
+		}
+
+		if _, err := tx.Exec(`
+			DELETE FROM recovery_codes WHERE user_id = $1
+			RETURNING NOTHING
+		`, authUserID); err != nil {
+			return err
+		}
+
+		for _, code := range recoveryCodes {
+			if _, err := tx.Exec(`
+				INSERT INTO recovery_codes (user_id, code_hash) VALUES ($1, $2)
+				RETURNING NOTHING
+			`, authUserID, hashToken(normalizeRecoveryCode(code))); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}); err == errTOTPAlreadyEnabled {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	} else if err == errTOTPNotEnrolled {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	} else if err == errInvalidTOTPCode {
+		respondJSON(w, map[string]string{
+			"code": err.Error(),
+		}, http.StatusUnprocessableEntity)
+		return
+	} else if err != nil {
+		respondError(w, fmt.Errorf("could not confirm TOTP: %v", err))
+		return
+	}
+
+	recordSecurityEvent(r, authUserID, eventTOTPEnabled, outcomeSuccess)
+
+	respondJSON(w, TOTPConfirmationPayload{recoveryCodes}, http.StatusOK)
+}
+
+func disableTOTP(w http.ResponseWriter, r *http.Request) {
+	var input TOTPInput
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer r.Body.Close()
+
+	ctx := r.Context()
+	authUserID := ctx.Value(keyAuthUserID).(string)
+
+	if err := crdb.ExecuteTx(ctx, db, nil, func(tx *sql.Tx) error {
+		var secret []byte
+		var enabled bool
+		var lastStep int64
+		if err := tx.QueryRow(`
+			SELECT totp_secret, totp_enabled, totp_last_step
+			FROM users
+			WHERE id = $1
+		`, authUserID).Scan(&secret, &enabled, &lastStep); err != nil {
+			return err
+		}
+
+		if !enabled {
+			return errTOTPNotEnrolled
+		}
+
+		// A lost authenticator can be disabled with a recovery code.
+		if err := useTOTPCode(tx, authUserID, secret, lastStep, input.Code); err != nil {
+			return err
+		}
+
+		// The last step stays so the code can't be replayed;
+		// enrolling again resets it along with the secret.
+		if _, err := tx.Exec(`
+			UPDATE users SET totp_enabled = false, totp_secret = NULL
+			WHERE id = $1
+			RETURNING NOTHING
+		`, authUserID); err != nil {
+			return err
+		}
+
+		_, err := tx.Exec(`
+			DELETE FROM recovery_codes WHERE user_id = $1
+			RETURNING NOTHING
+		`, authUserID)
+		return err
+	}); err == errTOTPNotEnrolled {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	} else if err == errInvalidTOTPCode {
+		recordSecurityEvent(r, authUserID, eventTOTPDisabled, outcomeFailure)
+		respondJSON(w, map[string]string{
+			"code": err.Error(),
+		}, http.StatusUnprocessableEntity)
+		return
+	} else if err != nil {
+		respondError(w, fmt.Errorf("could not disable TOTP: %v", err))
+		return
+	}
+
+	recordSecurityEvent(r, authUserID, eventTOTPDisabled, outcomeSuccess)
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// TestTOTPCode checks the SHA-1 test vectors of RFC 6238, appendix B,
+// truncated to the last totpDigits digits.
+func TestTOTPCode(t *testing.T) {
+	secret := []byte("12345678901234567890")
+	tests := []struct {
+		unix int64
+		want string
+	}{
+		{59, "94287082"},
+		{1111111109, "07081804"},
+		{1111111111, "14050471"},
+		{1234567890, "89005924"},
+		{2000000000, "69279037"},
+		{20000000000, "65353130"},
+	}
+	for _, tt := range tests {
+		want := tt.want[len(tt.want)-totpDigits:]
+		if got := totpCode(secret, tt.unix/totpPeriod); got != want {
+			t.Errorf("totpCode at %d = %q, want %q", tt.unix, got, want)
+		}
+	}
+}
+
+func TestVerifyTOTP(t *testing.T) {
+	secret := []byte("12345678901234567890")
+	current := time.Now().Unix() / totpPeriod
+	code := totpCode(secret, current)
+
+	step, ok := verifyTOTP(secret, code[:3]+" "+code[3:], 0)
+	if !ok || step != current {
+		t.Fatalf("verifyTOTP = %d, %v; want %d, true", step, ok, current)
+	}
+
+	if _, ok := verifyTOTP(secret, code, current); ok {
+		t.Error("verifyTOTP accepted a code already used")
+	}
+
+	if _, ok := verifyTOTP(secret, totpCode(secret, current+totpSkew+1), 0); ok {
+		t.Error("verifyTOTP accepted a code out of the window")
+	}
+}
@@ -1,13 +1,18 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"log"
 	"net/http"
+	"regexp"
+	"strconv"
 	"strings"
 	"time"
+	"unicode/utf8"
 
 	"github.com/cockroachdb/cockroach-go/crdb"
 	"github.com/go-chi/chi"
@@ -18,13 +23,24 @@ import (
 type CreateUserInput struct {
 	Email    string `json:"email"`
 	Username string `json:"username"`
+	Password string `json:"password,omitempty"`
 }
 
 // User model
 type User struct {
-	ID        string  `json:"-"`
-	Username  string  `json:"username"`
-	AvatarURL *string `json:"avatarUrl"`
+	ID            string  `json:"-"`
+	Username      string  `json:"username"`
+	AvatarURL     *string `json:"avatarUrl"`
+	Role          string  `json:"-"`
+	EmailVerified bool    `json:"-"`
+}
+
+// UpdateProfileInput request body
+type UpdateProfileInput struct {
+	Username    *string `json:"username"`
+	DisplayName *string `json:"displayName"`
+	Bio         *string `json:"bio"`
+	Private     *bool   `json:"private"`
 }
 
 // Profile model
@@ -32,21 +48,39 @@ type Profile struct {
 	Email           string    `json:"email,omitempty"`
 	Username        string    `json:"username"`
 	AvatarURL       *string   `json:"avatarUrl"`
+	DisplayName     *string   `json:"displayName"`
+	Bio             *string   `json:"bio"`
+	Private         bool      `json:"private"`
 	FollowersCount  int       `json:"followersCount"`
 	FollowingCount  int       `json:"followingCount"`
 	CreatedAt       time.Time `json:"createdAt"`
 	Me              bool      `json:"me"`
 	FollowerOfMine  bool      `json:"followerOfMine"`
 	FollowingOfMine bool      `json:"followingOfMine"`
+	FollowRequested bool      `json:"followRequested"`
+	Blocked         bool      `json:"blocked"`
+	Muted           bool      `json:"muted"`
 }
 
 // ToggleFollowPayload response body
 type ToggleFollowPayload struct {
 	FollowingOfMine bool `json:"followingOfMine"`
+	FollowRequested bool `json:"followRequested"`
 	FollowersCount  int  `json:"followersCount"`
 }
 
-var errFollowingMyself = errors.New("Try following someone else")
+var (
+	errFollowingMyself = errors.New("Try following someone else")
+	errEmailTaken      = errors.New("Email taken")
+	errUsernameTaken   = errors.New("Username taken")
+)
+
+var rxUsername = regexp.MustCompile(`^[a-zA-Z0-9_]{1,30}$`)
+
+const (
+	maxDisplayNameLength = 50
+	maxBioLength         = 480
+)
 
 func createUser(w http.ResponseWriter, r *http.Request) {
 	var input CreateUserInput
@@ -56,22 +90,59 @@ func createUser(w http.ResponseWriter, r *http.Request) {
 	}
 	defer r.Body.Close()
 
-	email := input.Email
+	// Every attempt counts, taken emails included,
+	// so they can't be enumerated at scale.
+	throttleKey := ipThrottleKey("signup", r)
+	if throttled(w, signupThrottler, throttleKey) {
+		return
+	}
+
+	email := strings.TrimSpace(input.Email)
 	username := input.Username
-	// TODO: validate input
+	if !rxEmail.MatchString(email) {
+		respondJSON(w, map[string]string{
+			"email": "Invalid email",
+		}, http.StatusUnprocessableEntity)
+		return
+	}
+	if !rxUsername.MatchString(username) {
+		respondJSON(w, map[string]string{
+			"username": "Invalid username",
+		}, http.StatusUnprocessableEntity)
+		return
+	}
 
-	var user Profile
-	err := db.QueryRowContext(r.Context(), `
-		INSERT INTO users (email, username) VALUES ($1, $2)
-		RETURNING created_at
-	`, email, username).Scan(&user.CreatedAt)
-	if errPq, ok := err.(*pq.Error); ok && errPq.Code.Name() == "unique_violation" {
-		if strings.Contains(errPq.Error(), "users_email_key") {
+	// Password is optional; users without one login with magic links.
+	var passwordHash []byte
+	if input.Password != "" {
+		if msg := validatePassword(input.Password); msg != "" {
 			respondJSON(w, map[string]string{
-				"email": "Email taken",
+				"password": msg,
 			}, http.StatusUnprocessableEntity)
 			return
 		}
+
+		var err error
+		if passwordHash, err = hashPassword(input.Password); err != nil {
+			respondError(w, fmt.Errorf("could not hash password: %v", err))
+			return
+		}
+	}
+
+	ctx := r.Context()
+	var user Profile
+	userID, createdAt, err := insertUser(ctx, email, username, passwordHash)
+	if err == errEmailTaken {
+		// Looks like a successful signup, so nobody can find out which emails are registered.
+		// The owner learns about it by email instead.
+		go sendAccountExistsNotice(email)
+		user.CreatedAt = time.Now()
+		user.Email = email
+		user.Username = username
+		user.Me = true
+		respondJSON(w, user, http.StatusCreated)
+		return
+	} else if err == errUsernameTaken {
 		respondJSON(w, map[string]string{
 			"username": "Username taken",
 		}, http.StatusUnprocessableEntity)
@@ -81,6 +152,14 @@ func createUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	recordSecurityEvent(r, userID, eventUserCreated, outcomeSuccess)
+
+	// The account is usable right away, but can't write until verified.
+	if err := sendVerificationEmail(ctx, userID, email); err != nil {
+		log.Printf("could not send verification email: %v\n", err)
+	}
+
+	user.CreatedAt = createdAt
 	user.Email = email
 	user.Username = username
 	user.Me = true
@@ -88,6 +167,34 @@ func createUser(w http.ResponseWriter, r *http.Request) {
 	respondJSON(w, user, http.StatusCreated)
 }
 
+func sendAccountExistsNotice(email string) {
+	if err := mailer.Send(email, "You already have a Nakama account", fmt.Sprintf(
+		"Someone tried to sign up on Nakama with this email, but you already have an account.\n"+
+			"Login at the link below. If it wasn't you, just ignore this email.\n\n%s\n",
+		origin+"/")); err != nil {
+		log.Printf("could not send account exists notice: %v\n", err)
+	}
+}
+
+// insertUser is the single path through which users get created,
+// either signing up or through an identity provider.
+// It returns the new user ID and creation time.
+func insertUser(ctx context.Context, email, username string, passwordHash []byte) (string, time.Time, error) {
+	var userID string
+	var createdAt time.Time
+	err := db.QueryRowContext(ctx, `
+		INSERT INTO users (email, username, password_hash) VALUES ($1, $2, $3)
+		RETURNING id, created_at
+	`, email, username, passwordHash).Scan(&userID, &createdAt)
+	if errPq, ok := err.(*pq.Error); ok && errPq.Code.Name() == "unique_violation" {
+		if strings.Contains(errPq.Error(), "users_email_key") {
+			return "", time.Time{}, errEmailTaken
+		}
+		return "", time.Time{}, errUsernameTaken
+	}
+	return userID, createdAt, err
+}
+
 // TODO: add pagination
 func getUsers(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
@@ -103,6 +210,9 @@ func getUsers(w http.ResponseWriter, r *http.Request) {
 		SELECT
 			users.username,
 			users.avatar_url,
+			users.display_name,
+			users.bio,
+			users.private,
 			users.followers_count,
 			users.following_count,
 			users.created_at`
@@ -110,7 +220,8 @@ func getUsers(w http.ResponseWriter, r *http.Request) {
 	if authenticated {
 		query += `,
 			following.following_id IS NOT NULL AS follower_of_mine,
-			followers.follower_id IS NOT NULL AS following_of_mine`
+			followers.follower_id IS NOT NULL AS following_of_mine,
+			follow_requests.follower_id IS NOT NULL AS follow_requested`
 		args = append(args, authUserID)
 	}
 	query += `
@@ -123,6 +234,9 @@ func getUsers(w http.ResponseWriter, r *http.Request) {
 			LEFT JOIN follows AS following
 				ON following.follower_id = users.id
 				AND following.following_id = $2
+			LEFT JOIN follow_requests
+				ON follow_requests.follower_id = $2
+				AND follow_requests.following_id = users.id
 			WHERE users.id != $2 AND`
 	} else {
 		query += `
@@ -144,6 +258,9 @@ func getUsers(w http.ResponseWriter, r *http.Request) {
 		dest := []interface{}{
 			&user.Username,
 			&user.AvatarURL,
+			&user.DisplayName,
+			&user.Bio,
+			&user.Private,
 			&user.FollowersCount,
 			&user.FollowingCount,
 			&user.CreatedAt,
@@ -152,6 +269,7 @@ func getUsers(w http.ResponseWriter, r *http.Request) {
 			dest = append(dest,
 				&user.FollowerOfMine,
 				&user.FollowingOfMine,
+				&user.FollowRequested,
 			)
 		}
 
@@ -180,6 +298,9 @@ func getUser(w http.ResponseWriter, r *http.Request) {
 			id,
 			email,
 			avatar_url,
+			display_name,
+			bio,
+			private,
 			followers_count,
 			following_count,
 			created_at`
@@ -195,7 +316,18 @@ func getUser(w http.ResponseWriter, r *http.Request) {
 				SELECT 1 FROM follows
 				WHERE follower_id = $2
 					AND following_id = (SELECT id FROM users WHERE username = $1)
-			) AS following_of_mine`
+			) AS following_of_mine,
+			EXISTS (
+				SELECT 1 FROM follow_requests
+				WHERE follower_id = $2
+					AND following_id = (SELECT id FROM users WHERE username = $1)
+			) AS follow_requested,
+			EXISTS (
+				SELECT 1 FROM blocks
+				WHERE blocker_id = $2
+					AND blocked_id = (SELECT id FROM users WHERE username = $1)
+			) AS blocked,
+			` + sqlMuted("$2", "(SELECT id FROM users WHERE username = $1)", false) + ` AS muted`
 		args = append(args, authUserID)
 	}
 	query += `
@@ -207,6 +339,9 @@ func getUser(w http.ResponseWriter, r *http.Request) {
 		&userID,
 		&user.Email,
 		&user.AvatarURL,
+		&user.DisplayName,
+		&user.Bio,
+		&user.Private,
 		&user.FollowersCount,
 		&user.FollowingCount,
 		&user.CreatedAt,
@@ -215,6 +350,9 @@ func getUser(w http.ResponseWriter, r *http.Request) {
 		dest = append(dest,
 			&user.FollowerOfMine,
 			&user.FollowingOfMine,
+			&user.FollowRequested,
+			&user.Blocked,
+			&user.Muted,
 		)
 	}
 
@@ -237,17 +375,133 @@ func getUser(w http.ResponseWriter, r *http.Request) {
 	respondJSON(w, user, http.StatusOK)
 }
 
+func updateProfile(w http.ResponseWriter, r *http.Request) {
+	var input UpdateProfileInput
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer r.Body.Close()
+
+	// Only the given fields change; empty display name and bio clear them.
+	var sets []string
+	var args []interface{}
+	errs := map[string]string{}
+	if input.Username != nil {
+		username := strings.TrimSpace(*input.Username)
+		if !rxUsername.MatchString(username) {
+			errs["username"] = "Invalid username"
+		}
+		args = append(args, username)
+		sets = append(sets, fmt.Sprintf("username = $%d", len(args)))
+	}
+	if input.DisplayName != nil {
+		displayName := strings.TrimSpace(*input.DisplayName)
+		if utf8.RuneCountInString(displayName) > maxDisplayNameLength {
+			errs["displayName"] = fmt.Sprintf("Display name must be at most %d characters long", maxDisplayNameLength)
+		}
+		args = append(args, nullIfEmpty(displayName))
+		sets = append(sets, fmt.Sprintf("display_name = $%d", len(args)))
+	}
+	if input.Bio != nil {
+		bio := strings.TrimSpace(*input.Bio)
+		if utf8.RuneCountInString(bio) > maxBioLength {
+			errs["bio"] = fmt.Sprintf("Bio must be at most %d characters long", maxBioLength)
+		}
+		args = append(args, nullIfEmpty(bio))
+		sets = append(sets, fmt.Sprintf("bio = $%d", len(args)))
+	}
+	if input.Private != nil {
+		args = append(args, *input.Private)
+		sets = append(sets, fmt.Sprintf("private = $%d", len(args)))
+	}
+	if len(errs) != 0 {
+		respondJSON(w, errs, http.StatusUnprocessableEntity)
+		return
+	}
+
+	if len(sets) == 0 {
+		http.Error(w, "Nothing to update", http.StatusBadRequest)
+		return
+	}
+
+	ctx := r.Context()
+	authUser := ctx.Value(keyAuthUser).(User)
+	authUserID := authUser.ID
+	args = append(args, authUserID)
+
+	var user Profile
+	var approvedIDs []string
+	err := crdb.ExecuteTx(ctx, db, nil, func(tx *sql.Tx) error {
+		// Going public approves the pending follow requests.
+		approvedIDs = nil
+		if input.Private != nil && !*input.Private {
+			var err error
+			if approvedIDs, err = approveAllFollowRequests(tx, authUserID); err != nil {
+				return err
+			}
+		}
+
+		return tx.QueryRow(`
+			UPDATE users SET `+strings.Join(sets, ", ")+`
+			WHERE id = $`+strconv.Itoa(len(args))+`
+			RETURNING email, username, avatar_url, display_name, bio, private, followers_count, following_count, created_at
+		`, args...).Scan(
+			&user.Email,
+			&user.Username,
+			&user.AvatarURL,
+			&user.DisplayName,
+			&user.Bio,
+			&user.Private,
+			&user.FollowersCount,
+			&user.FollowingCount,
+			&user.CreatedAt,
+		)
+	})
+	if errPq, ok := err.(*pq.Error); ok && errPq.Code.Name() == "unique_violation" {
+		respondJSON(w, map[string]string{
+			"username": "Username taken",
+		}, http.StatusUnprocessableEntity)
+		return
+	} else if err != nil {
+		respondError(w, fmt.Errorf("could not update profile: %v", err))
+		return
+	}
+
+	userCache.Invalidate(authUserID)
+	recordSecurityEvent(r, authUserID, eventProfileUpdated, outcomeSuccess)
+	for _, followerID := range approvedIDs {
+		go createFollowNotification(authUser, followerID, "follow_request_approved")
+	}
+
+	user.Me = true
+
+	respondJSON(w, user, http.StatusOK)
+}
+
+func nullIfEmpty(s string) *string {
+	if s == "" {
+		return nil
+	}
+	return &s
+}
+
+// toggleFollow follows or unfollows the user.
+// Following a private account asks for it instead,
+// and toggling again cancels the request.
 func toggleFollow(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 	authUser := ctx.Value(keyAuthUser).(User)
 	username := chi.URLParam(r, "username")
 
 	var userID string
-	var followingOfMine bool
+	var followingOfMine, followRequested bool
+	var event string
 	var followersCount int
 	if err := crdb.ExecuteTx(ctx, db, nil, func(tx *sql.Tx) error {
-		if err := tx.QueryRow("SELECT id FROM users WHERE username = $1", username).
-			Scan(&userID); err != nil {
+		var private bool
+		if err := tx.QueryRow("SELECT id, private FROM users WHERE username = $1", username).
+			Scan(&userID, &private); err != nil {
 			return err
 		}
 
@@ -255,17 +509,37 @@ func toggleFollow(w http.ResponseWriter, r *http.Request) {
 			return errFollowingMyself
 		}
 
-		if err := tx.QueryRow(`SELECT EXISTS (
-			SELECT 1 FROM follows
-			WHERE follower_id = $1
-				AND following_id = $2
-		)`, authUser.ID, userID).Scan(&followingOfMine); err != nil {
+		if blocked, err := isBlocked(tx, authUser.ID, userID); err != nil {
+			return err
+		} else if blocked {
+			return errBlocked
+		}
+
+		var following, requested bool
+		if err := tx.QueryRow(`SELECT
+			EXISTS (
+				SELECT 1 FROM follows
+				WHERE follower_id = $1
+					AND following_id = $2
+			),
+			EXISTS (
+				SELECT 1 FROM follow_requests
+				WHERE follower_id = $1
+					AND following_id = $2
+			)`, authUser.ID, userID).Scan(&following, &requested); err != nil {
 			return err
 		}
 
-		if followingOfMine {
+		var err error
+		switch {
+		case following:
+			followingOfMine, followRequested, event = false, false, eventUnfollow
+			followersCount, err = deleteFollow(tx, authUser.ID, userID)
+			return err
+		case requested:
+			followingOfMine, followRequested, event = false, false, eventFollowRequestCanceled
 			if _, err := tx.Exec(`
-				DELETE FROM follows
+				DELETE FROM follow_requests
 				WHERE follower_id = $1
 					AND following_id = $2
 				RETURNING NOTHING
@@ -273,57 +547,107 @@ func toggleFollow(w http.ResponseWriter, r *http.Request) {
 				return err
 			}
 
+			return tx.QueryRow("SELECT followers_count FROM users WHERE id = $1", userID).
+				Scan(&followersCount)
+		case private:
+			followingOfMine, followRequested, event = false, true, eventFollowRequested
 			if _, err := tx.Exec(`
-				UPDATE users SET following_count = following_count - 1
-				WHERE id = $1
+				INSERT INTO follow_requests (follower_id, following_id)
+				VALUES ($1, $2)
 				RETURNING NOTHING
-			`, authUser.ID); err != nil {
+			`, authUser.ID, userID); err != nil {
 				return err
 			}
 
-			return tx.QueryRow(`
-				UPDATE users SET followers_count = followers_count - 1
-				WHERE id = $1
-				RETURNING followers_count
-			`, userID).Scan(&followersCount)
+			return tx.QueryRow("SELECT followers_count FROM users WHERE id = $1", userID).
+				Scan(&followersCount)
 		}
 
-		if _, err := tx.Exec(`
-			INSERT INTO follows (follower_id, following_id)
-			VALUES ($1, $2)
-			RETURNING NOTHING
-		`, authUser.ID, userID); err != nil {
-			return err
-		}
-
-		if _, err := tx.Exec(`
-			UPDATE users SET following_count = following_count + 1
-			WHERE id = $1
-			RETURNING NOTHING
-		`, authUser.ID); err != nil {
-			return err
-		}
-
-		return tx.QueryRow(`
-			UPDATE users SET followers_count = followers_count + 1
-			WHERE id = $1
-			RETURNING followers_count
-		`, userID).Scan(&followersCount)
-	}); err == errFollowingMyself {
+		followingOfMine, followRequested, event = true, false, eventFollow
+		followersCount, err = insertFollow(tx, authUser.ID, userID)
+		return err
+	}); err == sql.ErrNoRows {
+		http.Error(w,
+			http.StatusText(http.StatusNotFound),
+			http.StatusNotFound)
+		return
+	} else if err == errFollowingMyself {
 		http.Error(w,
 			http.StatusText(http.StatusForbidden),
 			http.StatusForbidden)
 		return
+	} else if err == errBlocked {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
 	} else if err != nil {
 		respondError(w, fmt.Errorf("could not toggle follow: %v", err))
 		return
 	}
 
-	followingOfMine = !followingOfMine
+	recordSecurityEvent(r, authUser.ID, event, outcomeSuccess)
+
+	switch event {
+	case eventFollow:
+		go createFollowNotification(authUser, userID, "follow")
+	case eventFollowRequested:
+		go createFollowNotification(authUser, userID, "follow_request")
+	}
+
+	respondJSON(w, ToggleFollowPayload{followingOfMine, followRequested, followersCount}, http.StatusOK)
+}
+
+// insertFollow makes followerID follow followingID
+// and returns the new followers count of the latter.
+func insertFollow(tx *sql.Tx, followerID, followingID string) (int, error) {
+	if _, err := tx.Exec(`
+		INSERT INTO follows (follower_id, following_id)
+		VALUES ($1, $2)
+		RETURNING NOTHING
+	`, followerID, followingID); err != nil {
+		return 0, err
+	}
 
-	if followingOfMine {
-		go createFollowNotification(authUser, userID)
+	if _, err := tx.Exec(`
+		UPDATE users SET following_count = following_count + 1
+		WHERE id = $1
+		RETURNING NOTHING
+	`, followerID); err != nil {
+		return 0, err
 	}
 
-	respondJSON(w, ToggleFollowPayload{followingOfMine, followersCount}, http.StatusOK)
+	var followersCount int
+	err := tx.QueryRow(`
+		UPDATE users SET followers_count = followers_count + 1
+		WHERE id = $1
+		RETURNING followers_count
+	`, followingID).Scan(&followersCount)
+	return followersCount, err
+}
+
+// deleteFollow undoes insertFollow.
+func deleteFollow(tx *sql.Tx, followerID, followingID string) (int, error) {
+	if _, err := tx.Exec(`
+		DELETE FROM follows
+		WHERE follower_id = $1
+			AND following_id = $2
+		RETURNING NOTHING
+	`, followerID, followingID); err != nil {
+		return 0, err
+	}
+
+	if _, err := tx.Exec(`
+		UPDATE users SET following_count = following_count - 1
+		WHERE id = $1
+		RETURNING NOTHING
+	`, followerID); err != nil {
+		return 0, err
+	}
+
+	var followersCount int
+	err := tx.QueryRow(`
+		UPDATE users SET followers_count = followers_count - 1
+		WHERE id = $1
+		RETURNING followers_count
+	`, followingID).Scan(&followersCount)
+	return followersCount, err
 }
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/cockroachdb/cockroach-go/crdb"
+)
+
+// VerifyEmailInput request body
+type VerifyEmailInput struct {
+	Token string `json:"token"`
+}
+
+const (
+	emailVerificationTokenLifespan = time.Hour * 24
+	verificationEmailCooldown      = time.Minute * 5
+)
+
+// sendVerificationEmail generates a verification token for the given address
+// and mails it in the background.
+func sendVerificationEmail(ctx context.Context, userID, email string) error {
+	token, tokenHash, err := genToken()
+	if err != nil {
+		return err
+	}
+
+	// The token is bound to the address so it can't verify a different one later.
+	if _, err := db.ExecContext(ctx, `
+		INSERT INTO email_verification_tokens (token_hash, user_id, email, expires_at) VALUES ($1, $2, $3, $4)
+		RETURNING NOTHING
+	`, tokenHash, userID, email, time.Now().Add(emailVerificationTokenLifespan)); err != nil {
+		return err
+	}
+
+	go sendVerificationLink(email, token)
+
+	return nil
+}
+
+func sendVerificationLink(email, token string) {
+	link := origin + "/verify_email?token=" + url.QueryEscape(token)
+	if err := mailer.Send(email, "Verify your Nakama email", fmt.Sprintf(
+		"Click the link below to verify your email.\n\n%s\n\nIt expires in %s.\n"+
+			"If you didn't sign up, just ignore this email.\n",
+		link, emailVerificationTokenLifespan)); err != nil {
+		log.Printf("could not send verification link: %v\n", err)
+	}
+}
+
+// markEmailVerified if the user still has that email.
+// Magic links and identity providers prove ownership too.
+// Callers invalidate the cached user once committed.
+func markEmailVerified(ctx context.Context, e execer, userID, email string) error {
+	_, err := e.ExecContext(ctx, `
+		UPDATE users SET email_verified_at = now()
+		WHERE id = $1 AND email = $2 AND email_verified_at IS NULL
+		RETURNING NOTHING
+	`, userID, email)
+	return err
+}
+
+func verifyEmail(w http.ResponseWriter, r *http.Request) {
+	var input VerifyEmailInput
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer r.Body.Close()
+
+	ctx := r.Context()
+	var userID string
+	if err := crdb.ExecuteTx(ctx, db, nil, func(tx *sql.Tx) error {
+		var email string
+		var expiresAt time.Time
+		if err := tx.QueryRow(`
+			DELETE FROM email_verification_tokens WHERE token_hash = $1
+			RETURNING user_id, email, expires_at
+		`, hashToken(input.Token)).Scan(&userID, &email, &expiresAt); err != nil {
+			return err
+		}
+
+		if expiresAt.Before(time.Now()) {
+			return sql.ErrNoRows
+		}
+
+		if _, err := tx.Exec(`
+			DELETE FROM email_verification_tokens WHERE user_id = $1
+			RETURNING NOTHING
+		`, userID); err != nil {
+			return err
+		}
+
+		return markEmailVerified(ctx, tx, userID, email)
+	}); err == sql.ErrNoRows {
+		http.Error(w, "Invalid or expired token", http.StatusUnauthorized)
+		return
+	} else if err != nil {
+		respondError(w, fmt.Errorf("could not verify email: %v", err))
+		return
+	}
+
+	userCache.Invalidate(userID)
+	recordSecurityEvent(r, userID, eventEmailVerified, outcomeSuccess)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func resendVerificationEmail(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	authUserID := ctx.Value(keyAuthUserID).(string)
+
+	var email string
+	var verified bool
+	var lastSentAt *time.Time
+	if err := db.QueryRowContext(ctx, `
+		SELECT email, email_verified_at IS NOT NULL, (
+			SELECT max(created_at) FROM email_verification_tokens WHERE user_id = users.id
+		)
+		FROM users WHERE id = $1
+	`, authUserID).Scan(&email, &verified, &lastSentAt); err != nil {
+		respondError(w, fmt.Errorf("could not query user to resend verification email: %v", err))
+		return
+	}
+
+	if verified {
+		http.Error(w, "Email already verified", http.StatusConflict)
+		return
+	}
+
+	if lastSentAt != nil {
+		if wait := verificationEmailCooldown - time.Since(*lastSentAt); wait > 0 {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			http.Error(w, "Verification email sent recently, try again later", http.StatusTooManyRequests)
+			return
+		}
+	}
+
+	if err := sendVerificationEmail(ctx, authUserID, email); err != nil {
+		respondError(w, fmt.Errorf("could not send verification email: %v", err))
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// allowUnverified lets users who haven't verified their email yet through mustAuthUser.
+// It must come before it.
+func allowUnverified(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := context.WithValue(r.Context(), keyAllowUnverified, true)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}